@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+var (
+	maxConcurrentSessions = 10
+	connectionsPerMinute  = 10
+	connectionBurst       = 5
+	failedAuthBackoff     = 5 * time.Second
+	maxFailedAuthBackoff  = 10 * time.Minute
+	// maxTrackedClients bounds the number of source addresses tracked before
+	// idle clients are pruned.
+	maxTrackedClients = 1024
+)
+
+// guard enforces the connection limits on the ssh server.
+var guard = newAbuseGuard(nil)
+
+// clientRecord tracks the connection rate and failed logins of a single
+// source address.
+type clientRecord struct {
+	tokens       float64
+	lastSeen     time.Time
+	failures     int
+	blockedUntil time.Time
+}
+
+// abuseGuard limits the connection rate per source address, the number of
+// concurrent connections and backs off source addresses with failed logins; if
+// allowedNetworks is not empty, connections from other addresses are refused.
+type abuseGuard struct {
+	mutex           sync.Mutex
+	allowedNetworks []*net.IPNet
+	active          int
+	clients         map[string]*clientRecord
+	now             func() time.Time
+}
+
+func newAbuseGuard(allowedNetworks []*net.IPNet) *abuseGuard {
+	return &abuseGuard{
+		allowedNetworks: allowedNetworks,
+		clients:         make(map[string]*clientRecord),
+		now:             time.Now,
+	}
+}
+
+// parseAllowedCIDRs parses the allow-list from user-data.
+func parseAllowedCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// auditRejection records a rejected connection or login in the log and the
+// metrics.
+func auditRejection(reason, remoteAddr, detail string) {
+	log.Printf("audit: rejected connection from %s: %s (%s)\n", remoteAddr, reason, detail)
+	authRejectionsTotal.WithLabelValues(reason).Inc()
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (g *abuseGuard) isAllowed(ip string) bool {
+	if len(g.allowedNetworks) == 0 {
+		return true
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+	for _, network := range g.allowedNetworks {
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// client returns the record for ip, creating it if necessary; the caller must
+// hold the mutex.
+func (g *abuseGuard) client(ip string, now time.Time) *clientRecord {
+	record, ok := g.clients[ip]
+	if ok {
+		return record
+	}
+
+	if len(g.clients) >= maxTrackedClients {
+		g.prune(now)
+	}
+	record = &clientRecord{tokens: float64(connectionBurst), lastSeen: now}
+	g.clients[ip] = record
+	return record
+}
+
+// prune forgets clients which are neither blocked nor rate limited; the caller
+// must hold the mutex.
+func (g *abuseGuard) prune(now time.Time) {
+	for ip, record := range g.clients {
+		if now.After(record.blockedUntil) && now.Sub(record.lastSeen) > time.Minute {
+			delete(g.clients, ip)
+		}
+	}
+}
+
+// allowConnection checks a new connection from ip against the limits,
+// returning the reason if it is rejected.
+func (g *abuseGuard) allowConnection(ip string) (bool, string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if !g.isAllowed(ip) {
+		return false, "not_allowed"
+	}
+
+	now := g.now()
+	record := g.client(ip, now)
+	if now.Before(record.blockedUntil) {
+		return false, "auth_backoff"
+	}
+
+	// refill the token bucket for the time since the last connection
+	record.tokens += now.Sub(record.lastSeen).Minutes() * float64(connectionsPerMinute)
+	if record.tokens > float64(connectionBurst) {
+		record.tokens = float64(connectionBurst)
+	}
+	record.lastSeen = now
+	if record.tokens < 1 {
+		return false, "rate_limited"
+	}
+
+	if g.active >= maxConcurrentSessions {
+		return false, "too_many_sessions"
+	}
+
+	record.tokens--
+	g.active++
+	return true, ""
+}
+
+func (g *abuseGuard) release() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.active--
+}
+
+// recordAuthFailure blocks ip for a period which doubles with each
+// consecutive failed login.
+func (g *abuseGuard) recordAuthFailure(ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.now()
+	record := g.client(ip, now)
+	record.failures++
+
+	backoff := failedAuthBackoff
+	for i := 1; i < record.failures && backoff < maxFailedAuthBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxFailedAuthBackoff {
+		backoff = maxFailedAuthBackoff
+	}
+	record.blockedUntil = now.Add(backoff)
+}
+
+func (g *abuseGuard) recordAuthSuccess(ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if record, ok := g.clients[ip]; ok {
+		record.failures = 0
+	}
+}
+
+// trackedConn releases its slot in the concurrent connection limit when it is
+// closed.
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// connectionCallback is the ssh server ConnCallback; returning nil closes the
+// connection.
+func (g *abuseGuard) connectionCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	ip := remoteIP(conn.RemoteAddr())
+	allowed, reason := g.allowConnection(ip)
+	if !allowed {
+		auditRejection(reason, conn.RemoteAddr().String(), "connection refused")
+		return nil
+	}
+	return &trackedConn{Conn: conn, release: g.release}
+}
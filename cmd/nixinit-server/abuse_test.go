@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const testClientIP = "192.0.2.1"
+
+// testClock is a manually advanced clock for the abuse guard.
+type testClock struct {
+	current time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.current
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+func newTestGuard(allowedNetworks []*net.IPNet) (*abuseGuard, *testClock) {
+	clock := &testClock{current: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	g := newAbuseGuard(allowedNetworks)
+	g.now = clock.now
+	return g, clock
+}
+
+// expectConnection checks that a connection from ip is allowed, or rejected for
+// reason, releasing it if it is allowed.
+func expectConnection(t *testing.T, g *abuseGuard, ip, reason string) {
+	t.Helper()
+
+	allowed, rejection := g.allowConnection(ip)
+	if allowed {
+		g.release()
+	}
+	if reason == "" && !allowed {
+		t.Errorf("expected connection from %s to be allowed, rejected as %s", ip, rejection)
+	}
+	if reason != "" && rejection != reason {
+		t.Errorf("expected connection from %s to be rejected as %s, got allowed %v (%q)", ip, reason, allowed, rejection)
+	}
+}
+
+func TestAbuseGuardRateLimit(t *testing.T) {
+	g, clock := newTestGuard(nil)
+
+	for i := 0; i < connectionBurst; i++ {
+		expectConnection(t, g, testClientIP, "")
+	}
+	expectConnection(t, g, testClientIP, "rate_limited")
+	// the limit applies per source address
+	expectConnection(t, g, "192.0.2.2", "")
+
+	// a token is refilled every minute / connectionsPerMinute
+	clock.advance(time.Minute / time.Duration(connectionsPerMinute))
+	expectConnection(t, g, testClientIP, "")
+	expectConnection(t, g, testClientIP, "rate_limited")
+
+	// the bucket refills to no more than the burst
+	clock.advance(time.Hour)
+	for i := 0; i < connectionBurst; i++ {
+		expectConnection(t, g, testClientIP, "")
+	}
+	expectConnection(t, g, testClientIP, "rate_limited")
+}
+
+func TestAbuseGuardConcurrentSessions(t *testing.T) {
+	g, _ := newTestGuard(nil)
+
+	for i := 0; i < maxConcurrentSessions; i++ {
+		ip := net.IPv4(192, 0, 2, byte(i+1)).String()
+		if allowed, reason := g.allowConnection(ip); !allowed {
+			t.Fatalf("expected connection %d to be allowed, rejected as %s", i, reason)
+		}
+	}
+	expectConnection(t, g, "198.51.100.1", "too_many_sessions")
+
+	g.release()
+	expectConnection(t, g, "198.51.100.1", "")
+}
+
+func TestAbuseGuardAuthFailureBan(t *testing.T) {
+	g, clock := newTestGuard(nil)
+
+	g.recordAuthFailure(testClientIP)
+	expectConnection(t, g, testClientIP, "auth_backoff")
+	expectConnection(t, g, "192.0.2.2", "")
+	clock.advance(failedAuthBackoff)
+	expectConnection(t, g, testClientIP, "")
+
+	// the ban doubles with each consecutive failure
+	g.recordAuthFailure(testClientIP)
+	clock.advance(failedAuthBackoff)
+	expectConnection(t, g, testClientIP, "auth_backoff")
+	clock.advance(failedAuthBackoff)
+	expectConnection(t, g, testClientIP, "")
+
+	// and is capped at maxFailedAuthBackoff
+	for i := 0; i < 20; i++ {
+		g.recordAuthFailure(testClientIP)
+	}
+	clock.advance(maxFailedAuthBackoff - time.Second)
+	expectConnection(t, g, testClientIP, "auth_backoff")
+	clock.advance(time.Second)
+	expectConnection(t, g, testClientIP, "")
+
+	// a successful login resets the ban to its initial length
+	g.recordAuthSuccess(testClientIP)
+	g.recordAuthFailure(testClientIP)
+	clock.advance(failedAuthBackoff)
+	expectConnection(t, g, testClientIP, "")
+}
+
+func TestAbuseGuardAllowedNetworks(t *testing.T) {
+	networks, err := parseAllowedCIDRs([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	g, _ := newTestGuard(networks)
+
+	expectConnection(t, g, testClientIP, "")
+	expectConnection(t, g, "198.51.100.1", "not_allowed")
+
+	if _, err := parseAllowedCIDRs([]string{"192.0.2.1"}); err == nil {
+		t.Errorf("expected an address without a prefix length to be rejected")
+	}
+}
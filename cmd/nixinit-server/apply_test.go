@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	testInstanceID = "i-0123456789"
+	testToplevel   = "/nix/store/0123456789abcdfghijklmnpqrsvwxyz-nixos-system-test"
+)
+
+// fakeCall records a command run by the fakeExecutor.
+type fakeCall struct {
+	dir  string
+	name string
+	args []string
+}
+
+// fakeExecutor records the commands it is asked to run instead of running
+// them, failing with err if it is set.
+type fakeExecutor struct {
+	mutex sync.Mutex
+	calls []fakeCall
+	err   error
+}
+
+func (e *fakeExecutor) Run(ctx context.Context, dir, name string, args ...string) ([]byte, []byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.calls = append(e.calls, fakeCall{dir: dir, name: name, args: args})
+	if e.err != nil {
+		return nil, []byte("build failed"), e.err
+	}
+	return []byte("built"), nil, nil
+}
+
+func (e *fakeExecutor) recordedCalls() []fakeCall {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]fakeCall(nil), e.calls...)
+}
+
+// useTestEnvironment points the server at temporary directories and a fake
+// executor, restoring the originals when the test completes.
+func useTestEnvironment(t *testing.T) *fakeExecutor {
+	t.Helper()
+
+	previousDataDirectory := dataDirectory
+	previousEtcDirectory := nixosEtcDirectory
+	previousExecutor := commandExecutor
+	previousPrivileged := privileged
+	previousSystemProfile := systemProfile
+	previousInstanceID := serverInstanceID
+	t.Cleanup(func() {
+		if err := setDataDirectory(previousDataDirectory); err != nil {
+			t.Errorf("failed to restore data directory: %v", err)
+		}
+		nixosEtcDirectory = previousEtcDirectory
+		commandExecutor = previousExecutor
+		privileged = previousPrivileged
+		systemProfile = previousSystemProfile
+		serverInstanceID = previousInstanceID
+		setExpectedToplevel("")
+		setState(WaitingForNixConfig, nil)
+	})
+
+	if err := setDataDirectory(t.TempDir()); err != nil {
+		t.Fatalf("failed to set data directory: %v", err)
+	}
+	nixosEtcDirectory = filepath.Join(t.TempDir(), "etc", "nixos")
+	privileged = localPrivilegedOperations{}
+	serverInstanceID = testInstanceID
+	setState(WaitingForNixConfig, nil)
+
+	// the system profile links to the toplevel through a generation link, as
+	// it does after nixos-rebuild
+	profiles := t.TempDir()
+	if err := os.Symlink(testToplevel, filepath.Join(profiles, "system-2-link")); err != nil {
+		t.Fatalf("failed to create generation link: %v", err)
+	}
+	systemProfile = filepath.Join(profiles, "system")
+	if err := os.Symlink("system-2-link", systemProfile); err != nil {
+		t.Fatalf("failed to create system profile: %v", err)
+	}
+
+	fake := &fakeExecutor{}
+	commandExecutor = fake
+	return fake
+}
+
+// upload uploads data to filename in the upload directory of the test instance
+// through the sftp server.
+func upload(t *testing.T, client *sftp.Client, filename string, data string) {
+	t.Helper()
+
+	remotePath := path.Join(nixinitDirectory, testInstanceID, filepath.ToSlash(filename))
+	if err := writeRemoteFile(t, client, remotePath, data); err != nil {
+		t.Fatalf("failed to upload %s: %v", filename, err)
+	}
+}
+
+// countRebuilds returns the number of times nixos-rebuild was run by fake.
+func countRebuilds(fake *fakeExecutor) int {
+	var rebuilds int
+	for _, call := range fake.recordedCalls() {
+		if call.name == "nixos-rebuild" {
+			rebuilds++
+		}
+	}
+	return rebuilds
+}
+
+// startTestWatcher watches the upload directory of the test instance until the
+// test completes.
+func startTestWatcher(t *testing.T) {
+	t.Helper()
+
+	uploadDirectory := instanceUploadDirectory(testInstanceID)
+	if err := os.MkdirAll(uploadDirectory, 0750); err != nil {
+		t.Fatalf("failed to create upload directory: %v", err)
+	}
+	watcher, err := newDirectoryWatcher(uploadDirectory)
+	if err != nil {
+		t.Fatalf("failed to watch upload directory: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleWatchEvents(ctx, watcher, testInstanceID)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForState waits for the server to reach state.
+func waitForState(t *testing.T, state NixInitState) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if current, _ := getState(); current == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	current, lastError := getState()
+	t.Fatalf("timed out waiting for state %v, state is %v (last error %q)", state, current, lastError)
+}
+
+func TestUploadedConfigurationIsApplied(t *testing.T) {
+	fake := useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+	startTestWatcher(t)
+
+	configuration := "{ ... }: { networking.hostName = \"test\"; }\n"
+	upload(t, client, filepath.Join(secretsUploadDirectory, "token"), "s3cret")
+	upload(t, client, nixSettingsFile, "max_jobs: \"4\"\n")
+	upload(t, client, nixpkgsFile, "channel: nixos-24.11\n")
+	upload(t, client, configurationNixFile, configuration)
+
+	waitForState(t, NixConfigApplied)
+
+	calls := fake.recordedCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 commands, got %d: %v", len(calls), calls)
+	}
+	call := calls[0]
+	if call.name != "nixos-rebuild" || call.dir != nixosEtcDirectory {
+		t.Errorf("expected nixos-rebuild in %s, got %s in %s", nixosEtcDirectory, call.name, call.dir)
+	}
+	expectedArgs := []string{"boot", "--flake", nixosEtcDirectory + "#" + flakeHostname(), "--option", "max-jobs", "4"}
+	if len(call.args) != len(expectedArgs) {
+		t.Fatalf("expected args %v, got %v", expectedArgs, call.args)
+	}
+	for i := range expectedArgs {
+		if call.args[i] != expectedArgs[i] {
+			t.Errorf("expected args %v, got %v", expectedArgs, call.args)
+			break
+		}
+	}
+
+	if reboot := calls[1]; reboot.name != "systemd-run" || reboot.args[len(reboot.args)-1] != "reboot" {
+		t.Errorf("expected a reboot to be scheduled, got %s %v", reboot.name, reboot.args)
+	}
+	if toplevel := getStateSnapshot().ExpectedToplevel; toplevel != testToplevel {
+		t.Errorf("expected toplevel %s, got %q", testToplevel, toplevel)
+	}
+
+	applied, err := os.ReadFile(filepath.Join(nixosEtcDirectory, configurationNixFile))
+	if err != nil {
+		t.Fatalf("configuration.nix was not written to /etc/nixos: %v", err)
+	}
+	if string(applied) != configuration {
+		t.Errorf("expected configuration %q, got %q", configuration, applied)
+	}
+	for _, filename := range []string{"flake.nix", "hardware-configuration.nix", "README.md"} {
+		if _, err := os.Stat(filepath.Join(nixosEtcDirectory, filename)); err != nil {
+			t.Errorf("%s was not generated: %v", filename, err)
+		}
+	}
+
+	flake, err := os.ReadFile(filepath.Join(nixosEtcDirectory, "flake.nix"))
+	if err != nil {
+		t.Fatalf("failed to read flake.nix: %v", err)
+	}
+	for _, expected := range []string{`"github:nixos/nixpkgs/nixos-24.11"`, `mkDefault "24.11"`} {
+		if !strings.Contains(string(flake), expected) {
+			t.Errorf("expected flake.nix to contain %s, got:\n%s", expected, flake)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(secretsDirectory, "token"))
+	if err != nil {
+		t.Fatalf("secret was not imported: %v", err)
+	}
+	if info.Mode().Perm() != 0400 {
+		t.Errorf("expected secret to have mode 0400, got %v", info.Mode().Perm())
+	}
+	uploadedSecrets := filepath.Join(instanceUploadDirectory(testInstanceID), secretsUploadDirectory)
+	if _, err := os.Stat(uploadedSecrets); !os.IsNotExist(err) {
+		t.Errorf("expected uploaded secrets to be removed, got %v", err)
+	}
+}
+
+func TestInvalidNixSettingsAreRejected(t *testing.T) {
+	fake := useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+	startTestWatcher(t)
+
+	upload(t, client, nixSettingsFile, "max_jobs: lots\n")
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+
+	waitForState(t, NixinitError)
+
+	if calls := fake.recordedCalls(); len(calls) != 0 {
+		t.Errorf("expected no commands to be run, got %v", calls)
+	}
+}
+
+func TestFailedRebuildIsReported(t *testing.T) {
+	fake := useTestEnvironment(t)
+	fake.err = errors.New("exit status 1")
+	client := newTestSFTPClient(t)
+	startTestWatcher(t)
+
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+
+	waitForState(t, NixinitError)
+
+	snapshot := getStateSnapshot()
+	if !strings.HasPrefix(snapshot.LastApplyResult, "failed") {
+		t.Errorf("expected a failed apply result, got %q", snapshot.LastApplyResult)
+	}
+	if !strings.Contains(snapshot.LastError, "build failed") {
+		t.Errorf("expected the error to include the build output, got %q", snapshot.LastError)
+	}
+}
+
+func TestUploadToAnotherInstanceIsIgnored(t *testing.T) {
+	fake := useTestEnvironment(t)
+
+	otherDirectory := instanceUploadDirectory("i-other")
+	if err := os.MkdirAll(otherDirectory, 0750); err != nil {
+		t.Fatalf("failed to create upload directory: %v", err)
+	}
+	path := filepath.Join(otherDirectory, configurationNixFile)
+	if err := os.WriteFile(path, []byte("{ ... }: { }\n"), 0600); err != nil {
+		t.Fatalf("failed to write configuration: %v", err)
+	}
+
+	applier := newUploadApplier(testInstanceID)
+	handleNewFile(path, applier)
+
+	if len(applier.requests) != 0 {
+		t.Errorf("expected no apply to be requested")
+	}
+	if state, _ := getState(); state != WaitingForNixConfig {
+		t.Errorf("expected state to be unchanged, got %v", state)
+	}
+	if calls := fake.recordedCalls(); len(calls) != 0 {
+		t.Errorf("expected no commands to be run, got %v", calls)
+	}
+}
+
+func TestOptionalInputsAreRemovedOnceStaged(t *testing.T) {
+	useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+	upload(t, client, nixSettingsFile, "max_jobs: \"4\"\n")
+	upload(t, client, diskLayoutFile, "{ disko.devices = { }; }\n")
+	if err := privileged.StageConfig(testInstanceID); err != nil {
+		t.Fatalf("failed to stage upload: %v", err)
+	}
+	if !isInstallUpload(stagingDirectory) {
+		t.Errorf("expected the disk layout to be staged")
+	}
+
+	// an upload without a disk layout must rebuild rather than install again
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+	if err := privileged.StageConfig(testInstanceID); err != nil {
+		t.Fatalf("failed to stage upload: %v", err)
+	}
+	if isInstallUpload(stagingDirectory) {
+		t.Errorf("expected the disk layout of the previous upload not to be staged")
+	}
+	if settings, err := readNixSettings(filepath.Join(stagingDirectory, nixSettingsFile)); err != nil || settings.MaxJobs != "" {
+		t.Errorf("expected the nix settings of the previous upload not to be staged, got %+v: %v", settings, err)
+	}
+}
+
+func TestQueuedUploadsAreAppliedOnce(t *testing.T) {
+	fake := useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+
+	// uploads which complete while an apply is pending are applied together
+	applier := newUploadApplier(testInstanceID)
+	for i := 0; i < 3; i++ {
+		applier.request()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		applier.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitForState(t, NixConfigApplied)
+
+	// once a configuration is applied, the instance is about to reboot and
+	// another upload is not applied
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+	applier.request()
+	for len(applier.requests) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if rebuilds := countRebuilds(fake); rebuilds != 1 {
+		t.Errorf("expected 1 rebuild, got %d", rebuilds)
+	}
+}
+
+func TestEachUploadIsAppliedOnce(t *testing.T) {
+	fake := useTestEnvironment(t)
+	fake.err = errors.New("exit status 1")
+	client := newTestSFTPClient(t)
+	startTestWatcher(t)
+
+	// a failed apply leaves the server waiting for another upload
+	for i := 1; i <= 2; i++ {
+		upload(t, client, configurationNixFile, "{ ... }: { }\n")
+		sequence := getStateSnapshot().UploadSequence
+
+		deadline := time.Now().Add(5 * time.Second)
+		for getStateSnapshot().LastApplyUpload != sequence && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		waitForState(t, NixinitError)
+		// give any further applies triggered by the same upload time to run
+		time.Sleep(100 * time.Millisecond)
+
+		if rebuilds := countRebuilds(fake); rebuilds != i {
+			t.Fatalf("expected %d rebuilds after %d uploads, got %d", i, i, rebuilds)
+		}
+	}
+}
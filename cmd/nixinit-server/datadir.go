@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dataDirectory holds everything the server writes; it is the sftp root, so
+// uploads to /uploads/nixinit/<instance-id> are stored under
+// <data-dir>/uploads/nixinit/<instance-id>.
+var dataDirectory = "/var/lib/nixinit"
+
+// subdirectories of the data directory
+const (
+	uploadsSubdirectory = "uploads"
+	stagingSubdirectory = "staging"
+	secretsSubdirectory = "secrets"
+	logsSubdirectory    = "logs"
+)
+
+// applyLogFile receives the output of the commands run by the most recent
+// apply.
+const applyLogFile = "apply.log"
+
+// logDirectory is the directory to which apply logs are written.
+var logDirectory = filepath.Join(dataDirectory, logsSubdirectory)
+
+// setDataDirectory derives the sftp root, staging, secrets and log directories
+// from dir.
+func setDataDirectory(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("data directory %q is not an absolute path", dir)
+	}
+
+	dataDirectory = filepath.Clean(dir)
+	sftpRootDirectory = dataDirectory
+	stagingDirectory = filepath.Join(dataDirectory, stagingSubdirectory)
+	secretsDirectory = filepath.Join(dataDirectory, secretsSubdirectory)
+	logDirectory = filepath.Join(dataDirectory, logsSubdirectory)
+	return nil
+}
+
+// instanceUploadDirectory returns the directory to which the configuration
+// for instanceID is uploaded.
+func instanceUploadDirectory(instanceID string) string {
+	return addRootDirectory(sftpRootDirectory, filepath.Join(nixinitDirectory, instanceID))
+}
+
+// resetApplyLog removes the log of the previous apply.
+func resetApplyLog() {
+	err := os.Remove(filepath.Join(logDirectory, applyLogFile))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing apply log: %v\n", err)
+	}
+}
+
+// appendApplyLog records the output of a command run while applying a
+// configuration; failures are logged but do not fail the apply.
+func appendApplyLog(name string, args []string, stdout, stderr []byte) {
+	if err := os.MkdirAll(logDirectory, 0750); err != nil {
+		log.Printf("Error creating log directory: %v\n", err)
+		return
+	}
+
+	logPath := filepath.Clean(filepath.Join(logDirectory, applyLogFile))
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		log.Printf("Error opening apply log: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "$ %s %s\n%s%s\n", name, strings.Join(args, " "), stdout, stderr)
+	if err != nil {
+		log.Printf("Error writing apply log: %v\n", err)
+	}
+}
@@ -1,14 +1,25 @@
 {
   inputs = {
-    nixpkgs.url = "github:nixos/nixpkgs/nixos-24.05";
+    nixpkgs.url = "{{ .NixpkgsURL }}";
+{{- if .Install }}
+    disko = {
+      url = "github:nix-community/disko";
+      inputs.nixpkgs.follows = "nixpkgs";
+    };
+{{- end }}
   };
 
   outputs = { self, nixpkgs,  ... }@inputs: {
-    nixosConfigurations."nixos"  = nixpkgs.lib.nixosSystem {
-      system = "x86_64-linux";
+    nixosConfigurations."{{ .Hostname }}" = nixpkgs.lib.nixosSystem {
+      system = "{{ .System }}";
       specialArgs = { inherit inputs; };
       modules = [
         ./configuration.nix
+        { system.stateVersion = nixpkgs.lib.mkDefault "{{ .StateVersion }}"; }
+{{- if .Install }}
+        inputs.disko.nixosModules.disko
+        ./disk-layout.nix
+{{- end }}
       ];
     };
   };
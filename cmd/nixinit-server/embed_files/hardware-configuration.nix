@@ -8,13 +8,17 @@ in
 {
   boot.initrd.availableKernelModules = [ "virtio_net" "virtio_pci" "virtio_mmio" "virtio_blk" "virtio_scsi" "9p" "9pnet_virtio" ];
   boot.initrd.kernelModules = [ "virtio_balloon" "virtio_console" "virtio_rng" "virtio_gpu" ];
+{{- if eq .System "aarch64-linux" }}
+  boot.kernelParams = ["console=ttyAMA0"];
+{{- else }}
   boot.kernelParams = ["console=ttyS0"];
-
+{{- end }}
+{{ if not .Install }}
   fileSystems."/" = {
     device = "/dev/disk/by-label/nixos";
     fsType = "ext4";
   };
-
+{{ end }}
   swapDevices = [ ];
 
   # Enables DHCP on each ethernet and wireless interface. In case of scripted networking
@@ -24,9 +28,20 @@ in
   networking.useDHCP = lib.mkDefault true;
   # networking.interfaces.wlp0s20f3.useDHCP = lib.mkDefault true;
 
+  # when installing, the boot device is set from the disk layout by disko;
+  # aarch64 guests only boot with UEFI
   boot.loader.grub = {
     enable = true;
     efiSupport = true;
+{{- if eq .System "aarch64-linux" }}
+    efiInstallAsRemovable = true;
+{{- end }}
+{{- if not .Install }}
+{{- if eq .System "aarch64-linux" }}
+    device = "nodev";
+{{- else }}
     device = "${bootDevice}";
+{{- end }}
+{{- end }}
   };
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// event types which are sent to the webhook on state transitions
+const (
+	EventReadyForConfig = "ready_for_config"
+	EventBuildStarted   = "build_started"
+	EventBuildFailed    = "build_failed"
+	EventApplied        = "applied"
+	EventShuttingDown   = "shutting_down"
+)
+
+// signatureHeader carries the hex encoded HMAC-SHA256 of the request body,
+// keyed with the webhook secret from user-data.
+const signatureHeader = "X-Nixinit-Signature"
+
+// notifier sends events to the webhook configured in user-data; it is nil if
+// no webhook is configured.
+var notifier *webhookNotifier
+
+// Event is the JSON payload posted to the webhook.
+type Event struct {
+	Type       string    `json:"type"`
+	InstanceID string    `json:"instance_id"`
+	State      string    `json:"state"`
+	Timestamp  time.Time `json:"timestamp"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type webhookNotifier struct {
+	url            string
+	secret         []byte
+	client         *http.Client
+	events         chan Event
+	maxAttempts    int
+	initialBackoff time.Duration
+
+	// ctx is cancelled if the events cannot be delivered before shutdown
+	// times out, abandoning any retries
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mutex protects closed, which is set once the events channel is closed
+	mutex  sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newWebhookNotifier(url, secret string) *webhookNotifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookNotifier{
+		url:            url,
+		secret:         []byte(secret),
+		client:         &http.Client{Timeout: 10 * time.Second},
+		events:         make(chan Event, 32),
+		maxAttempts:    5,
+		initialBackoff: time.Second,
+		ctx:            ctx,
+		cancel:         cancel,
+		done:           make(chan struct{}),
+	}
+}
+
+// eventTypeForState returns the type of the event sent when the server
+// transitions to state, or the empty string if no event is sent.
+func eventTypeForState(state NixInitState) string {
+	switch state {
+	case WaitingForNixConfig:
+		return EventReadyForConfig
+	case ConfiguringNixSystem:
+		return EventBuildStarted
+	case NixinitError:
+		return EventBuildFailed
+	case NixConfigApplied:
+		return EventApplied
+	case ShuttingDown:
+		return EventShuttingDown
+	default:
+		return ""
+	}
+}
+
+// notifyState queues the event for a transition to state, if a webhook is
+// configured.
+func notifyState(state NixInitState, err error) {
+	eventType := eventTypeForState(state)
+	if notifier == nil || eventType == "" {
+		return
+	}
+
+	event := Event{
+		Type:       eventType,
+		InstanceID: serverInstanceID,
+		State:      state.String(),
+		Timestamp:  time.Now().UTC(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	notifier.notify(event)
+}
+
+// notify queues event for delivery without blocking; events are dropped if the
+// queue is full.
+func (n *webhookNotifier) notify(event Event) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return
+	}
+
+	select {
+	case n.events <- event:
+	default:
+		log.Printf("Webhook event queue full - dropping %s event\n", event.Type)
+	}
+}
+
+// run delivers queued events in order until the queue is closed.
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+	for event := range n.events {
+		if err := n.deliver(n.ctx, event); err != nil {
+			log.Printf("Error delivering %s event to webhook: %v\n", event.Type, err)
+		}
+	}
+}
+
+// stop closes the event queue and waits until the queued events have been
+// delivered or ctx is done, in which case the remaining events are abandoned.
+func (n *webhookNotifier) stop(ctx context.Context) {
+	n.mutex.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.events)
+	}
+	n.mutex.Unlock()
+
+	select {
+	case <-n.done:
+	case <-ctx.Done():
+		log.Printf("Timed out delivering webhook events: %v\n", ctx.Err())
+		n.cancel()
+	}
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of payload keyed with secret.
+func signPayload(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts event to the webhook, retrying with exponential backoff if the
+// request fails or the webhook does not return a 2xx status, until ctx is done.
+func (n *webhookNotifier) deliver(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	signature := "sha256=" + signPayload(n.secret, payload)
+
+	backoff := n.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err = n.post(ctx, payload, signature, event.Type)
+		if err == nil {
+			return nil
+		}
+		if attempt == n.maxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, err)
+		}
+
+		log.Printf("Attempt %d to deliver %s event failed: %v - retrying in %v\n", attempt, event.Type, err, backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %d attempts: %v", attempt, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) post(ctx context.Context, payload []byte, signature, eventType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nixinit-Event", eventType)
+	req.Header.Set(signatureHeader, signature)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
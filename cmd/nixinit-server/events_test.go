@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook records the requests posted to it, failing the first failures
+// of them with a 500.
+type testWebhook struct {
+	mutex      sync.Mutex
+	failures   int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (w *testWebhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.bodies = append(w.bodies, body)
+	w.signatures = append(w.signatures, r.Header.Get(signatureHeader))
+	if len(w.bodies) <= w.failures {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (w *testWebhook) attempts() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.bodies)
+}
+
+// newTestNotifier returns a notifier for webhook which retries without
+// waiting.
+func newTestNotifier(t *testing.T, webhook *testWebhook) *webhookNotifier {
+	t.Helper()
+
+	server := httptest.NewServer(webhook)
+	t.Cleanup(server.Close)
+	n := newWebhookNotifier(server.URL, "s3cret")
+	n.client = server.Client()
+	n.initialBackoff = time.Millisecond
+	return n
+}
+
+func TestWebhookSignature(t *testing.T) {
+	webhook := &testWebhook{}
+	n := newTestNotifier(t, webhook)
+	go n.run()
+
+	n.notify(Event{Type: EventApplied, InstanceID: testInstanceID, State: NixConfigApplied.String()})
+	n.stop(context.Background())
+
+	if webhook.attempts() != 1 {
+		t.Fatalf("expected 1 request, got %d", webhook.attempts())
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(webhook.bodies[0])
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(webhook.signatures[0]), []byte(expected)) {
+		t.Errorf("expected signature %s, got %s", expected, webhook.signatures[0])
+	}
+
+	var event Event
+	if err := json.Unmarshal(webhook.bodies[0], &event); err != nil {
+		t.Fatalf("failed to parse event: %v", err)
+	}
+	if event.Type != EventApplied || event.InstanceID != testInstanceID {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int
+		expectedAttempts int
+		delivered        bool
+	}{
+		{"first attempt", 0, 1, true},
+		{"after failures", 2, 3, true},
+		{"gives up", 10, 5, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			webhook := &testWebhook{failures: test.failures}
+			n := newTestNotifier(t, webhook)
+
+			err := n.deliver(context.Background(), Event{Type: EventBuildStarted})
+			if delivered := err == nil; delivered != test.delivered {
+				t.Errorf("expected delivered to be %v, got error %v", test.delivered, err)
+			}
+			if attempts := webhook.attempts(); attempts != test.expectedAttempts {
+				t.Errorf("expected %d attempts, got %d", test.expectedAttempts, attempts)
+			}
+			for i, body := range webhook.bodies[1:] {
+				if string(body) != string(webhook.bodies[0]) || webhook.signatures[i+1] != webhook.signatures[0] {
+					t.Errorf("expected retry %d to resend the same signed event", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookRetryIsCancelled(t *testing.T) {
+	webhook := &testWebhook{failures: 10}
+	n := newTestNotifier(t, webhook)
+	n.initialBackoff = time.Hour
+	go n.run()
+
+	n.notify(Event{Type: EventShuttingDown})
+	for webhook.attempts() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the notifier is waiting to retry, which stop abandons once its deadline
+	// passes rather than leaving delivery running
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	n.stop(ctx)
+	select {
+	case <-n.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected delivery to stop once the shutdown deadline passed")
+	}
+	if attempts := webhook.attempts(); attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+
+	if err := n.deliver(n.ctx, Event{Type: EventShuttingDown}); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Errorf("expected delivery with a cancelled context to fail, got %v", err)
+	}
+}
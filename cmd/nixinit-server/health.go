@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pterm/pterm"
+)
+
+var (
+	// httpAddr is the address of the optional http listener exposing the
+	// health, readiness, status and metrics endpoints; it is disabled if empty.
+	httpAddr      = ""
+	systemProfile = "/nix/var/nix/profiles/system"
+	// sshListening is set once the ssh server is accepting connections.
+	sshListening atomic.Bool
+)
+
+type serverStatus struct {
+	Version           string `json:"version"`
+	State             string `json:"state"`
+	InstanceID        string `json:"instance_id"`
+	Uptime            string `json:"uptime"`
+	UptimeSeconds     int64  `json:"uptime_seconds"`
+	LastError         string `json:"last_error,omitempty"`
+	CurrentGeneration int    `json:"current_generation,omitempty"`
+	ExpectedToplevel  string `json:"expected_toplevel,omitempty"`
+}
+
+type healthHandler struct {
+	instanceID string
+}
+
+// getCurrentGeneration returns the number of the current system generation,
+// which is encoded in the target of the system profile link, ie
+// /nix/var/nix/profiles/system -> system-<generation>-link.
+func getCurrentGeneration() (int, error) {
+	target, err := os.Readlink(systemProfile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read system profile: %v", err)
+	}
+
+	var generation int
+	_, err = fmt.Sscanf(filepath.Base(target), "system-%d-link", &generation)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse system profile link %s: %v", target, err)
+	}
+	return generation, nil
+}
+
+// healthz reports that the server process is up.
+func (h healthHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// readyz reports whether the server is accepting ssh connections and is ready
+// for a configuration to be uploaded.
+func (h healthHandler) readyz(w http.ResponseWriter, r *http.Request) {
+	state, _ := getState()
+	if !sshListening.Load() || !isReadyForConfig(state) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "not ready: %v\n", state)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "ready: %v\n", state)
+}
+
+func (h healthHandler) status(w http.ResponseWriter, r *http.Request) {
+	snapshot := getStateSnapshot()
+	uptime := time.Since(startTime).Round(time.Second)
+
+	status := serverStatus{
+		Version:          version,
+		State:            snapshot.State.String(),
+		InstanceID:       h.instanceID,
+		Uptime:           uptime.String(),
+		UptimeSeconds:    int64(uptime.Seconds()),
+		LastError:        snapshot.LastError,
+		ExpectedToplevel: snapshot.ExpectedToplevel,
+	}
+
+	generation, err := getCurrentGeneration()
+	if err != nil {
+		log.Printf("Error getting current generation: %v\n", err)
+	} else {
+		status.CurrentGeneration = generation
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("error writing status response: %v", err)
+	}
+}
+
+// startHTTPServer serves the health, readiness, status and metrics endpoints on
+// addr.
+func startHTTPServer(addr, instanceID string) {
+	handler := healthHandler{instanceID: instanceID}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", handler.healthz)
+	mux.HandleFunc("GET /readyz", handler.readyz)
+	mux.HandleFunc("GET /status", handler.status)
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	pterm.Info.Printf("Launching HTTP server on %v\n", addr)
+	err := server.ListenAndServe()
+	if err != nil {
+		log.Fatalf("Failed to start HTTP server: %v", err)
+	}
+}
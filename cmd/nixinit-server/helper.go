@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/pterm/pterm"
+)
+
+var (
+	// runHelper runs the binary as the privileged helper rather than the ssh
+	// front end.
+	runHelper = false
+	// helperSocket is the unix socket on which the helper listens; the front
+	// end delegates privileged operations to the helper if it is set.
+	helperSocket = ""
+	// helperGroup is the group which may connect to the helper socket when it
+	// is not passed in by systemd socket activation.
+	helperGroup = "nixinit"
+)
+
+// StageConfigArgs are the arguments of the Helper.StageConfig call.
+type StageConfigArgs struct {
+	InstanceID string
+}
+
+// Empty is used for calls without arguments or results.
+type Empty struct{}
+
+// ApplyReply is the result of the Helper.Apply call. net/rpc sends only the
+// message of an error, so a failed apply is reported in the reply to keep the
+// reason an upload was rejected.
+type ApplyReply struct {
+	Toplevel string
+	// Error is the message of the error the apply failed with, if any.
+	Error string
+	// ValidationFailure is the reason the upload was rejected, if it was
+	// rejected before a build was started.
+	ValidationFailure string
+}
+
+// Helper is the rpc service exposed by the privileged helper. It exposes only
+// the privileged operations, with no arguments other than the instance ID, so
+// that the front end cannot direct it at arbitrary paths.
+type Helper struct {
+	ops privilegedOperations
+
+	// mutex protects cancel, which cancels the in-flight apply, if any; it is
+	// held while staging so that an apply cannot start part way through
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+	ctx    context.Context
+}
+
+// MountCidata mounts the cidata volume.
+func (h *Helper) MountCidata(args Empty, reply *Empty) error {
+	log.Printf("helper: mounting cidata volume\n")
+	return h.ops.MountCidata()
+}
+
+// StageConfig stages the configuration uploaded for an instance; it fails while
+// a configuration is being applied, as the staged configuration is in use.
+func (h *Helper) StageConfig(args StageConfigArgs, reply *Empty) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.cancel != nil {
+		return errors.New("a configuration is being applied")
+	}
+
+	log.Printf("helper: staging configuration for instance %s\n", args.InstanceID)
+	return h.ops.StageConfig(args.InstanceID)
+}
+
+// Apply applies the staged configuration.
+func (h *Helper) Apply(args Empty, reply *ApplyReply) error {
+	h.mutex.Lock()
+	if h.cancel != nil {
+		h.mutex.Unlock()
+		return errors.New("a configuration is already being applied")
+	}
+	ctx, cancel := context.WithCancel(h.ctx)
+	h.cancel = cancel
+	h.mutex.Unlock()
+
+	defer func() {
+		h.mutex.Lock()
+		h.cancel = nil
+		h.mutex.Unlock()
+		cancel()
+	}()
+
+	log.Printf("helper: applying staged configuration\n")
+	toplevel, err := h.ops.Apply(ctx)
+	reply.Toplevel = toplevel
+	if err != nil {
+		reply.Error = err.Error()
+		var invalid *validationError
+		if errors.As(err, &invalid) {
+			reply.ValidationFailure = invalid.reason
+		}
+	}
+	return nil
+}
+
+// Cancel cancels the in-flight apply, if any.
+func (h *Helper) Cancel(args Empty, reply *Empty) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.cancel != nil {
+		log.Printf("helper: cancelling apply\n")
+		h.cancel()
+	}
+	return nil
+}
+
+// helperListener returns the listener passed in by systemd socket activation
+// or, failing that, listens on socketPath.
+func helperListener(socketPath string) (net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get socket activation listeners: %v", err)
+	}
+	if len(listeners) > 0 {
+		return listeners[0], nil
+	}
+
+	if socketPath == "" {
+		return nil, errors.New("no socket passed by systemd and --helper-socket not set")
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// only root and the front end's group may connect
+	group, err := user.LookupGroup(helperGroup)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to look up group %s: %v", helperGroup, err)
+	}
+	gid, err := strconv.Atoi(group.Gid)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("invalid gid for group %s: %v", helperGroup, err)
+	}
+	if err := os.Chown(socketPath, 0, gid); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set owner of socket: %v", err)
+	}
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions of socket: %v", err)
+	}
+	return listener, nil
+}
+
+// runPrivilegedHelper serves the privileged operations on the helper socket
+// until it receives SIGTERM or SIGINT.
+func runPrivilegedHelper() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	helper := &Helper{ops: localPrivilegedOperations{}, ctx: ctx}
+	server := rpc.NewServer()
+	if err := server.Register(helper); err != nil {
+		log.Fatalf("Failed to register helper service: %v", err)
+	}
+
+	listener, err := helperListener(helperSocket)
+	if err != nil {
+		log.Fatalf("Failed to listen for helper connections: %v", err)
+	}
+	pterm.Info.Printf("Privileged helper listening on %v\n", listener.Addr())
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				pterm.Info.Println("Privileged helper stopped")
+				return
+			}
+			log.Fatalf("Failed to accept helper connection: %v", err)
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+// helperClient delegates the privileged operations to the helper listening on
+// socketPath.
+type helperClient struct {
+	socketPath string
+}
+
+func (c helperClient) call(method string, args any) error {
+	client, err := rpc.Dial("unix", c.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to privileged helper: %v", err)
+	}
+	defer client.Close()
+	return client.Call(method, args, &Empty{})
+}
+
+func (c helperClient) MountCidata() error {
+	return c.call("Helper.MountCidata", Empty{})
+}
+
+func (c helperClient) StageConfig(instanceID string) error {
+	return c.call("Helper.StageConfig", StageConfigArgs{InstanceID: instanceID})
+}
+
+// Apply asks the helper to apply the staged configuration; if ctx is cancelled
+// the helper is asked to cancel the apply.
+func (c helperClient) Apply(ctx context.Context) (string, error) {
+	client, err := rpc.Dial("unix", c.socketPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to privileged helper: %v", err)
+	}
+	defer client.Close()
+
+	reply := &ApplyReply{}
+	call := client.Go("Helper.Apply", Empty{}, reply, nil)
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		if err := c.call("Helper.Cancel", Empty{}); err != nil {
+			log.Printf("Error cancelling apply: %v\n", err)
+		}
+		<-call.Done
+	}
+	switch {
+	case call.Error != nil:
+		return "", call.Error
+	case reply.ValidationFailure != "":
+		return "", &validationError{reason: reply.ValidationFailure, err: errors.New(reply.Error)}
+	case reply.Error != "":
+		return "", errors.New(reply.Error)
+	}
+	return reply.Toplevel, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// diskLayoutFile is the name of the disko disk layout which, when uploaded
+// alongside configuration.nix, switches the server into install mode: the
+// target disk is partitioned according to the layout and the configuration is
+// installed to it with nixos-install.
+const diskLayoutFile = "disk-layout.nix"
+
+var (
+	installRoot = "/mnt"
+	diskoFlake  = "github:nix-community/disko"
+)
+
+// isInstallUpload returns true if a disk layout was uploaded to uploadDirectory.
+func isInstallUpload(uploadDirectory string) bool {
+	_, err := os.Stat(filepath.Join(uploadDirectory, diskLayoutFile))
+	return err == nil
+}
+
+// runNixosInstall partitions and mounts the target disk described by the
+// uploaded disk layout and installs the uploaded configuration to it.
+func runNixosInstall(ctx context.Context, uploadDirectory string, params configurationParams, settingsArgs []string) error {
+	// disko destroys any existing data on the disks in the layout, formats them
+	// and mounts them under /mnt
+	log.Printf("Partitioning disks...\n")
+	diskoArgs := []string{"--extra-experimental-features", "nix-command flakes"}
+	diskoArgs = append(diskoArgs, settingsArgs...)
+	diskoArgs = append(diskoArgs, "run", diskoFlake, "--", "--mode", "disko", "--root-mountpoint", installRoot,
+		filepath.Join(uploadDirectory, diskLayoutFile))
+	if err := runCommand(ctx, "nix", diskoArgs...); err != nil {
+		return fmt.Errorf("error partitioning disks: %v", err)
+	}
+
+	log.Printf("Generating configuration files...\n")
+	etcDirectory := filepath.Join(installRoot, nixosEtcDirectory)
+	err := generateConfigurationFiles(uploadDirectory, etcDirectory, params)
+	if err != nil {
+		return fmt.Errorf("error generating configuration files: %v", err)
+	}
+
+	// secrets are imported into the installed system, not the bootstrap system
+	err = importSecrets(uploadDirectory, filepath.Join(installRoot, secretsDirectory))
+	if err != nil {
+		return fmt.Errorf("error importing secrets: %v", err)
+	}
+
+	installArgs := []string{"--root", installRoot, "--flake", flakeReference(etcDirectory, params), "--no-root-passwd"}
+	installArgs = append(installArgs, settingsArgs...)
+	if err := runCommand(ctx, "nixos-install", installArgs...); err != nil {
+		return err
+	}
+
+	log.Printf("Installation complete\n")
+	return nil
+}
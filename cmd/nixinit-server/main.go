@@ -2,17 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 
+	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/sftp"
 
@@ -32,13 +40,20 @@ const (
 	ShuttingDown
 	NixinitError
 	UnableToDetermineInstanceID
+	NixConfigApplied
+)
+
+// version and commit are set at build time with -ldflags "-X main.version=..."
+var (
+	version = "dev"
+	commit  = "unknown"
 )
 
 var (
 	port                 = 2222
 	host                 = "0.0.0.0"
 	validUser            = "nixinit"
-	sftpRootDirectory    = ""
+	sftpRootDirectory    = dataDirectory
 	currentState         = WaitingForNixConfig
 	nixinitDirectory     = "/uploads/nixinit" // should not have trailing /
 	configurationNixFile = "configuration.nix"
@@ -49,17 +64,39 @@ var (
 var nixFiles embed.FS
 
 type responseParams struct {
-	ServerVersion string
-	ServerStatus  string
-	Uptime        string
-	LaunchTime    string
+	ServerVersion    string `json:"server_version"`
+	ServerCommit     string `json:"server_commit"`
+	ServerStatus     string `json:"server_status"`
+	InstanceID       string `json:"instance_id"`
+	Cloud            string `json:"cloud"`
+	Uptime           string `json:"uptime"`
+	LaunchTime       string `json:"launch_time"`
+	SystemUptime     string `json:"system_uptime"`
+	ShutdownDeadline string `json:"shutdown_deadline"`
+	LastApplyResult  string `json:"last_apply_result"`
+	// UploadSequence is the number of the most recent upload of
+	// configuration.nix, and LastApplyUpload that of the upload which
+	// LastApplyResult belongs to.
+	UploadSequence  int64 `json:"upload_sequence"`
+	LastApplyUpload int64 `json:"last_apply_upload"`
+	// ExpectedToplevel is the store path of the system which is booted after
+	// the reboot which follows a successful apply.
+	ExpectedToplevel string `json:"expected_toplevel,omitempty"`
 }
 
 var responseTemplate = `
 -----
-nixinit-server version: {{ .ServerVersion }}
+nixinit-server version: {{ .ServerVersion }} (commit {{ .ServerCommit }})
 nixinit-server state: {{ .ServerStatus }}
+instance ID: {{ .InstanceID }}
+cloud: {{ .Cloud }}
 uptime: {{ .Uptime }} (since {{ .LaunchTime }})
+system uptime: {{ .SystemUptime }}
+shutdown deadline: {{ .ShutdownDeadline }}
+last apply: {{ .LastApplyResult }}{{ if .LastApplyUpload }} (upload {{ .LastApplyUpload }} of {{ .UploadSequence }}){{ end }}
+{{- if .ExpectedToplevel }}
+expected system: {{ .ExpectedToplevel }}
+{{- end }}
 -----
 
 Welcome to nixinit-server!
@@ -85,18 +122,68 @@ func (n NixInitState) String() string {
 		return "SHUTTING_DOWN"
 	case NixinitError:
 		return "NIXINIT_ERROR"
+	case UnableToDetermineInstanceID:
+		return "UNABLE_TO_DETERMINE_INSTANCE_ID"
+	case NixConfigApplied:
+		return "NIX_CONFIG_APPLIED"
 	default:
 		return "UNKNOWN"
 	}
 }
 
-func generateStandardResponse() (string, error) {
-	launchTime := time.Now().Add(-24 * time.Hour) // Assume the server started 24 hours ago
+func getResponseParams() responseParams {
+	snapshot := getStateSnapshot()
 	data := responseParams{
-		ServerVersion: "0.0.1",
-		ServerStatus:  currentState.String(),
-		Uptime:        time.Since(launchTime).String(),
-		LaunchTime:    launchTime.Format(time.RFC3339),
+		ServerVersion:    version,
+		ServerCommit:     commit,
+		ServerStatus:     snapshot.State.String(),
+		InstanceID:       serverInstanceID,
+		Cloud:            detectedCloud,
+		Uptime:           time.Since(startTime).Round(time.Second).String(),
+		LaunchTime:       startTime.Format(time.RFC3339),
+		ShutdownDeadline: snapshot.ShutdownDeadline.Format(time.RFC3339),
+		LastApplyResult:  snapshot.LastApplyResult,
+		UploadSequence:   snapshot.UploadSequence,
+		LastApplyUpload:  snapshot.LastApplyUpload,
+		ExpectedToplevel: snapshot.ExpectedToplevel,
+	}
+
+	if data.Cloud == "" {
+		data.Cloud = "none"
+	}
+	if data.LastApplyResult == "" {
+		data.LastApplyResult = "none"
+	}
+	if snapshot.ShutdownDeadline.IsZero() {
+		data.ShutdownDeadline = "none"
+	}
+
+	systemUptime, err := getSystemUptime()
+	if err != nil {
+		log.Printf("Error getting system uptime: %v\n", err)
+		data.SystemUptime = "unknown"
+	} else {
+		data.SystemUptime = systemUptime.Round(time.Second).String()
+	}
+
+	return data
+}
+
+// generateStandardResponse renders the banner shown to ssh clients; format is
+// either text or json.
+func generateStandardResponse(format string) (string, error) {
+	data := getResponseParams()
+
+	switch format {
+	case "text":
+	case "json":
+		response, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("error marshalling response: %v", err)
+		}
+		return string(response) + "\n", nil
+	default:
+		return "", fmt.Errorf("unsupported format %q - must be text or json", format)
 	}
 
 	tmpl, err := template.New("response").Parse(responseTemplate)
@@ -115,33 +202,41 @@ func generateStandardResponse() (string, error) {
 	return result, nil
 }
 
+// parseResponseFormat parses the command sent by the ssh client, which may be
+// used to request the banner in a different format, ie
+// ssh -p 2222 nixinit@<host> --format json
+func parseResponseFormat(command []string) (string, error) {
+	flags := flag.NewFlagSet("nixinit-server", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	format := flags.String("format", "text", "format of the response (text or json)")
+	if err := flags.Parse(command); err != nil {
+		return "", err
+	}
+	return *format, nil
+}
+
 func sshSessionHandler(s ssh.Session) {
 	pterm.Info.Println("new SSH session request")
+	sshSessionsTotal.WithLabelValues("shell").Inc()
 
-	if s.User() != validUser {
-		pterm.Info.Println("user invalid - terminating session...")
-		_, err := s.Write([]byte("user invalid - closing ssh session...\n"))
-		if err != nil {
-			log.Printf("error writing to session: %v", err)
-		}
-		err = s.Exit(0)
-		if err != nil {
-			log.Printf("error exiting session: %v", err)
-		}
-		return
-	}
+	// publicKeyHandler rejects, and counts, logins as any user but validUser
+	// before a session is started
 
 	authorizedKey := gossh.MarshalAuthorizedKey(s.PublicKey())
 	pterm.Info.Printf("log in attempt - user public key: %v\n", string(authorizedKey))
 
-	standardResponse, err := generateStandardResponse()
+	var standardResponse string
+	format, err := parseResponseFormat(s.Command())
+	if err == nil {
+		standardResponse, err = generateStandardResponse(format)
+	}
 	if err != nil {
 		pterm.Error.Printf("error generating standard response: %v\n", err)
-		_, err = s.Write([]byte(standardResponse))
+		_, err = fmt.Fprintf(s.Stderr(), "error generating response: %v\n", err)
 		if err != nil {
 			log.Printf("error writing to session: %v", err)
 		}
-		err = s.Exit(0)
+		err = s.Exit(1)
 		if err != nil {
 			log.Printf("error exiting session: %v", err)
 		}
@@ -158,6 +253,13 @@ func sshSessionHandler(s ssh.Session) {
 }
 
 func publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+	ip := remoteIP(ctx.RemoteAddr())
+	if ctx.User() != validUser {
+		auditRejection("invalid_user", ctx.RemoteAddr().String(), fmt.Sprintf("user %q", ctx.User()))
+		guard.recordAuthFailure(ip)
+		return false
+	}
+	guard.recordAuthSuccess(ip)
 	return true // allow all keys, or use ssh.KeysEqual() to compare against known keys
 }
 
@@ -171,6 +273,11 @@ func (f fileGetHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 		return nil, sftp.ErrSshFxPermissionDenied
 	}
 
+	// Uploaded secrets cannot be read back
+	if isSecretsPath(r.Filepath) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+
 	transformedDirectory := addRootDirectory(sftpRootDirectory, path)
 	transformedFilename := filepath.Join(transformedDirectory, filename)
 	pterm.Info.Printf("file download request - path: %s, filename: %s\n", path, filename)
@@ -225,36 +332,114 @@ func (f filePutHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSshFxFailure
 	}
 
-	// Open the file for writing
+	// Open a temporary file for writing; it replaces the file once the upload
+	// completes
 	cleanedPath := filepath.Clean(transformedFilename)
-	file, err := os.OpenFile(cleanedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	file, err := os.CreateTemp(transformedDirectory, "."+filename+".*"+partialUploadSuffix)
 	if err != nil {
 		return nil, sftp.ErrSshFxFailure
 	}
+	uploadsTotal.Inc()
 
-	return file, nil
+	return &uploadedFile{countingFile: countingFile{file}, path: cleanedPath}, nil
+}
+
+// partialUploadSuffix ends the name of the temporary file an upload is written
+// to.
+const partialUploadSuffix = ".partial"
+
+// isPartialUpload returns true if filename is the temporary file of an upload
+// which has not completed.
+func isPartialUpload(filename string) bool {
+	return strings.HasPrefix(filename, ".") && strings.HasSuffix(filename, partialUploadSuffix)
+}
+
+// uploadedFile is an upload being written to a temporary file alongside path.
+// It is renamed to path once the client closes it, so that the file watcher
+// only sees complete uploads, or removed if the transfer fails.
+type uploadedFile struct {
+	countingFile
+	path   string
+	failed atomic.Bool
+}
+
+func (f *uploadedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.countingFile.WriteAt(p, off)
+	if err != nil {
+		f.failed.Store(true)
+	}
+	return n, err
+}
+
+// TransferError is called by the sftp server if the session ends while the
+// file is still open.
+func (f *uploadedFile) TransferError(err error) {
+	log.Printf("Upload of %s failed: %v\n", f.path, err)
+	f.failed.Store(true)
+}
+
+func (f *uploadedFile) Close() error {
+	err := f.File.Close()
+	if err == nil && f.failed.Load() {
+		err = fmt.Errorf("upload of %s did not complete", f.path)
+	}
+	if err == nil {
+		err = moveUploadIntoPlace(f.Name(), f.path)
+	}
+	if err != nil {
+		if removeErr := os.Remove(f.Name()); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Printf("Error removing partial upload %s: %v\n", f.Name(), removeErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// uploadMutex is held while an upload is moved into place and while an upload
+// is staged, so that the upload number recorded with the result of an apply is
+// that of the configuration which was staged.
+var uploadMutex sync.Mutex
+
+// moveUploadIntoPlace renames src to dst, numbering the upload if dst is the
+// configuration of this instance.
+func moveUploadIntoPlace(src, dst string) error {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if dst == filepath.Join(instanceUploadDirectory(serverInstanceID), configurationNixFile) {
+		log.Printf("Upload %d of configuration.nix completed\n", recordUpload())
+	}
+	return nil
 }
 
 type fileCmdHandler struct{}
 
 func (f fileCmdHandler) Filecmd(r *sftp.Request) error {
 	pterm.Info.Printf("file command request - method: %s, path: %s, target: %s\n", r.Method, r.Filepath, r.Target)
-	path := r.Filepath
-	targetPath := r.Target
 
 	// Check if the path is under /uploads/nixinit
-	if !strings.HasPrefix(path, nixinitDirectory) {
+	if !strings.HasPrefix(r.Filepath, nixinitDirectory) {
 		return sftp.ErrSshFxPermissionDenied
 	}
+	path := addRootDirectory(sftpRootDirectory, r.Filepath)
+	targetPath := addRootDirectory(sftpRootDirectory, r.Target)
 
 	switch r.Method {
 	case "Rename":
 		// Check if the target path is also under /uploads/nixinit
-		if !strings.HasPrefix(targetPath, nixinitDirectory) {
+		if !strings.HasPrefix(r.Target, nixinitDirectory) {
 			return sftp.ErrSshFxPermissionDenied
 		}
 
-		err := os.Rename(path, targetPath)
+		// Secrets cannot be moved out of (or into) the secrets directory
+		if isSecretsPath(r.Filepath) != isSecretsPath(r.Target) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+
+		err := moveUploadIntoPlace(path, targetPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				return sftp.ErrSshFxNoSuchFile
@@ -309,6 +494,11 @@ func (f fileListHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		return nil, sftp.ErrSshFxPermissionDenied
 	}
 
+	// Uploaded secrets cannot be listed
+	if isSecretsPath(r.Filepath) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+
 	transformedDirectory := addRootDirectory(sftpRootDirectory, path)
 	transformedFilename := filepath.Join(transformedDirectory, filename)
 
@@ -327,7 +517,7 @@ func (f fileListHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	}
 
 	// Read the directory contents
-	entries, err := os.ReadDir(path)
+	entries, err := os.ReadDir(transformedFilename)
 	if err != nil {
 		return nil, sftp.ErrSshFxFailure
 	}
@@ -360,6 +550,7 @@ func (f listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
 }
 
 func sftpHandler(sess ssh.Session) {
+	sshSessionsTotal.WithLabelValues("sftp").Inc()
 	serverOptions := []sftp.RequestServerOption{}
 
 	handlers := sftp.Handlers{
@@ -401,43 +592,63 @@ func removeRootDirectory(root, path string) (string, error) {
 	return strings.TrimSuffix(pathWithSuffix, "/"), nil
 }
 
-func watchDirectory(dirPath, instanceID string) error {
-	watcher, err := fsnotify.NewWatcher()
+// watchDirectory handles files uploaded to dirPath until ctx is done.
+func watchDirectory(ctx context.Context, dirPath, instanceID string) error {
+	watcher, err := newDirectoryWatcher(dirPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer watcher.Close()
+	handleWatchEvents(ctx, watcher, instanceID)
+	return nil
+}
 
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Op&fsnotify.Create == fsnotify.Create || event.Op&fsnotify.Write == fsnotify.Write {
-					pterm.Info.Printf("File created or modified: %v\n", event.Name)
-
-					// Handle other new files/directories
-					handleNewFile(event.Name, instanceID)
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Println("Error:", err)
-			}
-		}
-	}()
+// newDirectoryWatcher returns a watcher for the files in dirPath.
+func newDirectoryWatcher(dirPath string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating watcher: %v", err)
+	}
 
 	err = watcher.Add(dirPath)
 	if err != nil {
+		watcher.Close()
 		log.Printf("Error adding watcher to directory: %v\n", err)
-		return fmt.Errorf("error adding watcher to directory: %v", err)
+		return nil, fmt.Errorf("error adding watcher to directory: %v", err)
+	}
+	return watcher, nil
+}
+
+// handleWatchEvents handles the files uploaded to the watched directory until
+// ctx is done, and then closes watcher. Uploads are renamed into place once
+// complete, so only the creation of a file is of interest; the configuration
+// is applied in the background so that events are not held up by a build.
+func handleWatchEvents(ctx context.Context, watcher *fsnotify.Watcher, instanceID string) {
+	defer watcher.Close()
+
+	applier := newUploadApplier(instanceID)
+	go applier.run(ctx)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				pterm.Info.Printf("File created: %v\n", event.Name)
+
+				// Handle other new files/directories
+				handleNewFile(event.Name, applier)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Error:", err)
+		case <-ctx.Done():
+			return
+		}
 	}
-	<-done
-	return nil
 }
 
 // extractInstanceId extracts the instanceId from the directory path - the instanceId
@@ -460,38 +671,84 @@ func extractInstanceID(directory string) (string, error) {
 
 func copyFile(src, dst string) error {
 	cleanedSrc := filepath.Clean(src)
-	sourceFile, err := os.Open(cleanedSrc)
+	data, err := hostFilesystem.ReadFile(cleanedSrc)
 	if err != nil {
 		return err
 	}
-	defer sourceFile.Close()
 
-	// Create new file
 	cleanedDst := filepath.Clean(dst)
-	destFile, err := os.Create(cleanedDst)
+	return hostFilesystem.WriteFile(cleanedDst, data, 0644)
+}
+
+func writeEmbeddedFile(fs embed.FS, srcPath, destPath string) error {
+	data, err := fs.ReadFile(srcPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to read embedded file %s: %v", srcPath, err)
 	}
-	defer destFile.Close()
 
-	// Copy the bytes to destination from source
-	_, err = io.Copy(destFile, sourceFile)
+	err = hostFilesystem.WriteFile(destPath, data, 0600)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to write file %s: %v", destPath, err)
 	}
 
-	// Sync to ensure writes are completed
-	err = destFile.Sync()
-	return err
+	return nil
 }
 
-func writeEmbeddedFile(fs embed.FS, srcPath, destPath string) error {
+// configurationParams are the parameters used to render the embedded flake.nix
+// and hardware-configuration.nix templates.
+type configurationParams struct {
+	// Install is true when the configuration is installed to a disk which is
+	// partitioned according to an uploaded disk layout.
+	Install bool
+	// System is the nix system of the running machine, ie x86_64-linux.
+	System string
+	// Hostname is the name of the nixosConfigurations attribute in the flake.
+	Hostname string
+	// NixpkgsURL is the url of the nixpkgs input of the flake.
+	NixpkgsURL string
+	// StateVersion is the default system.stateVersion of the configuration.
+	StateVersion string
+}
+
+// newConfigurationParams returns the parameters for the running machine,
+// building with the nixpkgs selected by source.
+func newConfigurationParams(install bool, source NixpkgsSource) (configurationParams, error) {
+	system, err := nixSystem()
+	if err != nil {
+		return configurationParams{}, err
+	}
+	return configurationParams{
+		Install:      install,
+		System:       system,
+		Hostname:     flakeHostname(),
+		NixpkgsURL:   source.flakeURL(),
+		StateVersion: source.StateVersion,
+	}, nil
+}
+
+// flakeReference returns the reference to the configuration generated in
+// etcDirectory, ie /etc/nixos#<hostname>.
+func flakeReference(etcDirectory string, params configurationParams) string {
+	return etcDirectory + "#" + params.Hostname
+}
+
+func writeEmbeddedTemplate(fs embed.FS, srcPath, destPath string, params configurationParams) error {
 	data, err := fs.ReadFile(srcPath)
 	if err != nil {
 		return fmt.Errorf("failed to read embedded file %s: %v", srcPath, err)
 	}
 
-	err = os.WriteFile(destPath, data, 0600)
+	tmpl, err := template.New(filepath.Base(srcPath)).Parse(string(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse embedded template %s: %v", srcPath, err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, params); err != nil {
+		return fmt.Errorf("failed to render embedded template %s: %v", srcPath, err)
+	}
+
+	err = hostFilesystem.WriteFile(destPath, rendered.Bytes(), 0600)
 	if err != nil {
 		return fmt.Errorf("failed to write file %s: %v", destPath, err)
 	}
@@ -499,28 +756,49 @@ func writeEmbeddedFile(fs embed.FS, srcPath, destPath string) error {
 	return nil
 }
 
-func generateConfigurationFiles(configurationPath string) error {
-	// copy file from configurationPath to /etc/nixos/configuration.nix
-	err := copyFile(configurationPath, filepath.Join(nixosEtcDirectory, "configuration.nix"))
+// generateConfigurationFiles writes the uploaded configuration together with
+// the generated flake to etcDirectory.
+func generateConfigurationFiles(uploadDirectory, etcDirectory string, params configurationParams) error {
+	if err := hostFilesystem.MkdirAll(etcDirectory, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", etcDirectory, err)
+	}
+
+	// copy file from the upload directory to /etc/nixos/configuration.nix
+	err := copyFile(filepath.Join(uploadDirectory, configurationNixFile), filepath.Join(etcDirectory, "configuration.nix"))
 	if err != nil {
 		log.Printf("Error copying configuration file: %v\n", err)
 		return err
 	}
 
+	if params.Install {
+		err := copyFile(filepath.Join(uploadDirectory, diskLayoutFile), filepath.Join(etcDirectory, diskLayoutFile))
+		if err != nil {
+			log.Printf("Error copying disk layout file: %v\n", err)
+			return err
+		}
+	}
+
+	// a lock file generated by the client pins the inputs of the flake
+	err = copyFile(filepath.Join(uploadDirectory, flakeLockFile), filepath.Join(etcDirectory, flakeLockFile))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error copying flake lock file: %v\n", err)
+		return err
+	}
+
 	// Write flake.nix
-	if err := writeEmbeddedFile(nixFiles, "embed_files/flake.nix", filepath.Join(nixosEtcDirectory, "flake.nix")); err != nil {
+	if err := writeEmbeddedTemplate(nixFiles, "embed_files/flake.nix", filepath.Join(etcDirectory, "flake.nix"), params); err != nil {
 		log.Printf("Error writing flake.nix: %v\n", err)
 		return err
 	}
 
 	// Write hardware-configuration.nix
-	if err := writeEmbeddedFile(nixFiles, "embed_files/hardware-configuration.nix", filepath.Join(nixosEtcDirectory, "hardware-configuration.nix")); err != nil {
+	if err := writeEmbeddedTemplate(nixFiles, "embed_files/hardware-configuration.nix", filepath.Join(etcDirectory, "hardware-configuration.nix"), params); err != nil {
 		log.Printf("Error writing hardware-configuration.nix: %v\n", err)
 		return err
 	}
 
 	// Write README.md
-	if err := writeEmbeddedFile(nixFiles, "embed_files/README.md", filepath.Join(nixosEtcDirectory, "README.md")); err != nil {
+	if err := writeEmbeddedFile(nixFiles, "embed_files/README.md", filepath.Join(etcDirectory, "README.md")); err != nil {
 		log.Printf("Error writing README.md: %v\n", err)
 		return err
 	}
@@ -529,37 +807,93 @@ func generateConfigurationFiles(configurationPath string) error {
 	return nil
 }
 
-func runNixosRebuild(configurationPath string) error {
-	log.Printf("Generating configuration files...\n")
-	// TODO: remove reference to home/test-user
-	err := generateConfigurationFiles(filepath.Join("/home/test-user", configurationPath))
+// validationError is returned when an upload is rejected before a build is
+// started; reason labels the rejection in validationFailuresTotal.
+type validationError struct {
+	reason string
+	err    error
+}
+
+func (e *validationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *validationError) Unwrap() error {
+	return e.err
+}
+
+// applyConfiguration applies the configuration staged in uploadDirectory; if a
+// disk layout was uploaded with it, the configuration is installed to disk,
+// otherwise the running system is rebuilt. The new system becomes the default
+// boot entry and a reboot into it is scheduled; its toplevel store path is
+// returned so that the client can verify the system after the reboot.
+func applyConfiguration(ctx context.Context, uploadDirectory string) (string, error) {
+	resetApplyLog()
+
+	// nix settings are optional and are uploaded to the same directory as
+	// configuration.nix
+	nixSettings, err := readNixSettings(filepath.Join(uploadDirectory, nixSettingsFile))
 	if err != nil {
-		return fmt.Errorf("error generating configuration files: %v", err)
+		return "", &validationError{reason: "nix_settings", err: err}
 	}
+	settingsArgs, cleanupSettings, err := nixSettings.nixArgs()
+	if err != nil {
+		return "", fmt.Errorf("error applying nix settings: %v", err)
+	}
+	defer cleanupSettings()
 
-	// create a new nixos generation
-	// assume this is being run in privileged mode
-	log.Printf("Running nixos-rebuild...\n")
-	cmd := exec.Command("nixos-rebuild", "build")
-	cmd.Dir = nixosEtcDirectory
+	// the nixpkgs source is optional; the default channel is used if it was
+	// not uploaded
+	nixpkgsSource, err := readNixpkgsSource(filepath.Join(uploadDirectory, nixpkgsFile))
+	if err != nil {
+		return "", &validationError{reason: "nixpkgs", err: err}
+	}
+	params, err := newConfigurationParams(isInstallUpload(uploadDirectory), nixpkgsSource)
+	if err != nil {
+		return "", err
+	}
 
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+	root := "/"
+	if params.Install {
+		root = installRoot
+		err = runNixosInstall(ctx, uploadDirectory, params, settingsArgs)
+	} else {
+		err = runNixosRebuild(ctx, uploadDirectory, params, settingsArgs)
+	}
+	if err != nil {
+		return "", err
+	}
 
-	log.Printf("Running nixos-rebuild...")
-	err = cmd.Run()
+	toplevel, err := resolveToplevel(root)
 	if err != nil {
-		return fmt.Errorf("error running nixos build-vm: %v, stderr: %s", err, stderr.String())
+		return "", err
 	}
+	log.Printf("New system %s will be booted\n", toplevel)
+	return toplevel, scheduleReboot(ctx)
+}
 
-	log.Printf("nixos-rebuild complete: %s\n", out.String())
-	return nil
+func runNixosRebuild(ctx context.Context, uploadDirectory string, params configurationParams, settingsArgs []string) error {
+	log.Printf("Generating configuration files...\n")
+	err := generateConfigurationFiles(uploadDirectory, nixosEtcDirectory, params)
+	if err != nil {
+		return fmt.Errorf("error generating configuration files: %v", err)
+	}
 
+	// secrets are moved out of the upload directory before the build so that
+	// the configuration can refer to them
+	err = importSecrets(uploadDirectory, secretsDirectory)
+	if err != nil {
+		return fmt.Errorf("error importing secrets: %v", err)
+	}
+
+	// create a new nixos generation and make it the default boot entry; it is
+	// activated by the reboot which follows
+	// assume this is being run in privileged mode
+	rebuildArgs := []string{"boot", "--flake", flakeReference(nixosEtcDirectory, params)}
+	return runCommandInDirectory(ctx, nixosEtcDirectory, "nixos-rebuild", append(rebuildArgs, settingsArgs...)...)
 }
 
-func handleNewFile(filePath, instanceID string) {
+func handleNewFile(filePath string, applier *uploadApplier) {
 	// Add your logic here to handle the new file
 	// For example, you could process the file, move it, etc.
 	pterm.Info.Printf("file watcher: New file uploaded: %s\n", filePath)
@@ -574,86 +908,233 @@ func handleNewFile(filePath, instanceID string) {
 	if strings.HasPrefix(directory, nixinitDirectory) {
 		instanceIDInPath, _ := extractInstanceID(directory)
 		pterm.Info.Printf("Instance ID in path: %s\n", instanceIDInPath)
-		if instanceIDInPath == instanceID {
+		if instanceIDInPath == applier.instanceID {
 			pterm.Info.Printf("File uploaded to correct instance directory...%v\n", directory)
 			if filename == configurationNixFile {
-				pterm.Info.Printf("Configuration.nix file uploaded - starting nix reconfigure... \n")
-				err := runNixosRebuild(filepath.Join(directory, filename))
-				if err == nil {
-					log.Printf("New nix configuration applied - rebooting in 30 seconds...\n")
-				} else {
-					log.Printf("Error applying new nix configuration - please upload a new configuration...\n")
-				}
+				applier.request()
 			}
 		} else {
 			pterm.Info.Printf("Instance directory does not match: %s\n", directory)
+			validationFailuresTotal.WithLabelValues("instance_mismatch").Inc()
+		}
+	}
+}
+
+// uploadApplier applies the configuration uploaded for an instance, one apply
+// at a time. Uploads which complete while an apply is running are collapsed
+// into a single further apply, which stages the most recent of them.
+type uploadApplier struct {
+	instanceID string
+	// requests holds a pending request to apply the upload, if any
+	requests chan struct{}
+}
+
+func newUploadApplier(instanceID string) *uploadApplier {
+	return &uploadApplier{instanceID: instanceID, requests: make(chan struct{}, 1)}
+}
+
+// request asks for the upload to be applied; it does nothing if a request is
+// already pending.
+func (a *uploadApplier) request() {
+	select {
+	case a.requests <- struct{}{}:
+	default:
+		pterm.Info.Printf("Configuration.nix already waiting to be applied\n")
+	}
+}
+
+// run applies the upload for each request until ctx is done.
+func (a *uploadApplier) run(ctx context.Context) {
+	for {
+		select {
+		case <-a.requests:
+			a.apply()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func startWatcher(sftpRootDirectory, path, file, instanceID string) {
+// apply stages and applies the upload.
+func (a *uploadApplier) apply() {
+	if !applies.begin() {
+		pterm.Warning.Printf("Configuration.nix file uploaded while shutting down - ignoring\n")
+		return
+	}
+	defer applies.end()
+
+	// a reboot into the applied configuration is already scheduled, which
+	// would interrupt another apply
+	if state, _ := getState(); state == NixConfigApplied {
+		pterm.Warning.Printf("Configuration.nix file uploaded after a configuration was applied - ignoring as the instance is about to reboot\n")
+		return
+	}
+
+	pterm.Info.Printf("Configuration.nix file uploaded - starting nix reconfigure... \n")
+	setState(ConfiguringNixSystem, nil)
+	start := time.Now()
+	// the upload is staged first so that it cannot be modified while
+	// it is being applied
+	var toplevel string
+	uploadMutex.Lock()
+	upload := getUploadSequence()
+	err := privileged.StageConfig(a.instanceID)
+	uploadMutex.Unlock()
+	if err == nil {
+		toplevel, err = privileged.Apply(applyContext)
+	}
+	observeApply(start, err)
+	recordApplyResult(upload, err)
+	if err == nil {
+		setExpectedToplevel(toplevel)
+		setState(NixConfigApplied, nil)
+		log.Printf("New nix configuration applied - rebooting in %v...\n", rebootDelay)
+	} else {
+		setState(NixinitError, err)
+		log.Printf("Error applying new nix configuration: %v\n", err)
+		log.Printf("Please upload a new configuration...\n")
+	}
+}
+
+func startWatcher(ctx context.Context, sftpRootDirectory, path, file, instanceID string) {
 	// we assume this directory already exists
 	transformedDirectory := addRootDirectory(sftpRootDirectory, path)
 
 	pterm.Info.Printf("Watching directory: %s\n", transformedDirectory)
 
 	// Start watching the directory in a goroutine
-	err := watchDirectory(transformedDirectory, instanceID)
+	err := watchDirectory(ctx, transformedDirectory, instanceID)
 	if err != nil {
 		log.Fatalf("Failed to start watching directory: %v", err)
 	}
 }
 
+// newSSHServer returns the ssh server which serves the status to ssh sessions
+// and accepts uploads over sftp.
+func newSSHServer(addr string) *ssh.Server {
+	return &ssh.Server{
+		Addr:             addr,
+		Handler:          sshSessionHandler,
+		PublicKeyHandler: publicKeyHandler,
+		ConnCallback:     guard.connectionCallback,
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": sftpHandler,
+		},
+	}
+}
+
 func startShutdownHandler(timerDuration time.Duration) {
+	deadline := time.Now().Add(timerDuration)
+	setShutdownDeadline(deadline)
 	pterm.Info.Printf("Starting shutdown handler with timer duration: %v - system will shut down at %v\n",
-		timerDuration, time.Now().Add(timerDuration).Format(time.RFC3339))
+		timerDuration, deadline.Format(time.RFC3339))
 
 	// Set up a timer to shut down the system after the specified duration
 	timer := time.NewTimer(timerDuration)
 	<-timer.C
 
 	pterm.Info.Println("Shutdown handler triggered - system will shut down now")
+	setState(ShuttingDown, nil)
 }
 
 func main() {
+	flag.StringVar(&httpAddr, "http-addr", httpAddr, "address for the health, readiness and status http endpoints (disabled if empty)")
+	flag.IntVar(&maxConcurrentSessions, "max-sessions", maxConcurrentSessions, "maximum number of concurrent ssh connections")
+	flag.IntVar(&connectionsPerMinute, "connections-per-minute", connectionsPerMinute, "maximum rate of new ssh connections from a single address")
+	flag.BoolVar(&runHelper, "helper", runHelper, "run as the privileged helper instead of the ssh server")
+	flag.StringVar(&helperSocket, "helper-socket", helperSocket, "unix socket of the privileged helper (privileged operations run in-process if empty)")
+	flag.StringVar(&helperGroup, "helper-group", helperGroup, "group permitted to connect to the privileged helper socket")
+	flag.StringVar(&dataDirectory, "data-dir", dataDirectory, "directory holding uploads, staged configurations, secrets and logs")
+	flag.Parse()
+
+	if err := setDataDirectory(dataDirectory); err != nil {
+		log.Fatalf("Invalid data directory: %v", err)
+	}
+
+	if runHelper {
+		runPrivilegedHelper()
+		return
+	}
+	if helperSocket != "" {
+		pterm.Info.Printf("Delegating privileged operations to helper on %s\n", helperSocket)
+		privileged = helperClient{socketPath: helperSocket}
+	}
+
+	// stop on SIGTERM (from systemd) or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
 
 	instanceID, err := getInstanceID()
 	if err != nil {
 		log.Fatalf("Failed to get instance ID - continuing in unusable state%v", err)
-		currentState = UnableToDetermineInstanceID
+		setState(UnableToDetermineInstanceID, err)
 	}
+	serverInstanceID = instanceID
 
-	if sftpRootDirectory == "" {
-		// set sftpRootDirectory to the current working directory
-		sftpRootDirectory, err = os.Getwd()
-		if err != nil {
-			log.Fatalf("Failed to get current working directory: %v", err)
-		}
-		// make subdirectories /uploads/nixinit under the sftpRootDirectory
-		nixinitUploadsDirectory := addRootDirectory(sftpRootDirectory, nixinitDirectory)
-		instanceUploadsDirectory := filepath.Join(nixinitUploadsDirectory, instanceID)
-		err = os.MkdirAll(instanceUploadsDirectory, 0750)
-		if err != nil {
-			log.Fatalf("Failed to create directory %s: %v", nixinitUploadsDirectory, err)
-		}
+	userData, err := getUserData()
+	if err != nil {
+		log.Printf("Failed to read user data - continuing without it: %v\n", err)
+	}
+	if userData.WebhookURL != "" {
+		pterm.Info.Printf("Sending events to webhook %s\n", userData.WebhookURL)
+		notifier = newWebhookNotifier(userData.WebhookURL, userData.WebhookSecret)
+		go notifier.run()
+	}
+
+	allowedNetworks, err := parseAllowedCIDRs(userData.AllowedCIDRs)
+	if err != nil {
+		log.Fatalf("Failed to parse allowed CIDRs from user data: %v", err)
+	}
+	if len(allowedNetworks) > 0 {
+		pterm.Info.Printf("Only accepting ssh connections from %v\n", userData.AllowedCIDRs)
+	}
+	guard = newAbuseGuard(allowedNetworks)
+
+	// make the upload directory for this instance under the data directory
+	instanceUploadsDirectory := instanceUploadDirectory(instanceID)
+	err = os.MkdirAll(instanceUploadsDirectory, 0750)
+	if err != nil {
+		log.Fatalf("Failed to create directory %s: %v", instanceUploadsDirectory, err)
 	}
 
 	timerDuration := time.Hour
 	go startShutdownHandler(timerDuration)
 
-	go startWatcher(sftpRootDirectory, filepath.Join(nixinitDirectory, instanceID), configurationNixFile, instanceID)
+	go startWatcher(ctx, sftpRootDirectory, filepath.Join(nixinitDirectory, instanceID), configurationNixFile, instanceID)
+
+	if httpAddr != "" {
+		go startHTTPServer(httpAddr, instanceID)
+	}
 
 	serverEndpoint := fmt.Sprintf("%s:%d", host, port)
 
-	server := ssh.Server{
-		Addr:             serverEndpoint,
-		Handler:          sshSessionHandler,
-		PublicKeyHandler: publicKeyHandler,
-		SubsystemHandlers: map[string]ssh.SubsystemHandler{
-			"sftp": sftpHandler,
-		},
-	}
+	server := newSSHServer(serverEndpoint)
 	pterm.Info.Printf("Launching SSH server on %v\n", serverEndpoint)
 
-	log.Fatal(server.ListenAndServe())
+	listener, err := net.Listen("tcp", serverEndpoint)
+	if err != nil {
+		log.Fatalf("Failed to listen on %v: %v", serverEndpoint, err)
+	}
+	sshListening.Store(true)
+	state, _ := getState()
+	notifyState(state, nil)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	notifySystemd(daemon.SdNotifyReady)
+	notifySystemd("STATUS=" + state.String())
+	go runWatchdog(ctx)
+
+	select {
+	case err := <-serveErr:
+		log.Fatalf("SSH server failed: %v", err)
+	case <-ctx.Done():
+	}
+
+	// stop receiving signals so a second SIGINT terminates immediately
+	stop()
+	gracefulShutdown(server)
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// allStates lists every server state so that the state gauge reports 0 for
+// all states other than the current one.
+var allStates = []NixInitState{
+	WaitingForNixConfig,
+	ConfiguringNixSystem,
+	ShuttingDown,
+	NixinitError,
+	UnableToDetermineInstanceID,
+	NixConfigApplied,
+}
+
+var (
+	sshSessionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nixinit_ssh_sessions_total",
+		Help: "Number of ssh sessions, by type (shell or sftp).",
+	}, []string{"type"})
+
+	authRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nixinit_auth_rejections_total",
+		Help: "Number of rejected ssh logins, by reason.",
+	}, []string{"reason"})
+
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nixinit_uploads_total",
+		Help: "Number of files uploaded over sftp.",
+	})
+
+	uploadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "nixinit_upload_bytes_total",
+		Help: "Number of bytes uploaded over sftp.",
+	})
+
+	validationFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nixinit_validation_failures_total",
+		Help: "Number of uploads rejected before a build was started, by reason.",
+	}, []string{"reason"})
+
+	applyDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nixinit_rebuild_duration_seconds",
+		Help:    "Time taken to apply an uploaded configuration, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 10),
+	}, []string{"outcome"})
+
+	stateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nixinit_state",
+		Help: "Current state of the nixinit server; 1 for the current state, 0 otherwise.",
+	}, []string{"state"})
+)
+
+func init() {
+	recordState(WaitingForNixConfig)
+}
+
+// recordState sets the state gauge to reflect state.
+func recordState(state NixInitState) {
+	for _, s := range allStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		stateGauge.WithLabelValues(s.String()).Set(value)
+	}
+}
+
+// observeApply records the duration and outcome of applying a configuration
+// which was started at start, counting an upload rejected before the build as
+// a validation failure.
+func observeApply(start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	applyDurationSeconds.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		validationFailuresTotal.WithLabelValues(invalid.reason).Inc()
+	}
+}
+
+// countingFile counts the bytes written to an uploaded file.
+type countingFile struct {
+	*os.File
+}
+
+func (f countingFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	uploadBytesTotal.Add(float64(n))
+	return n, err
+}
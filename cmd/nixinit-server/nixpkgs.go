@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// nixpkgsFile is the name of the optional file, uploaded alongside
+// configuration.nix, which selects the nixpkgs used by the generated flake.
+const nixpkgsFile = "nixpkgs.yaml"
+
+// flakeLockFile is the name of an optional lock file for the generated flake;
+// if it is uploaded, the remote build uses exactly the locked inputs.
+const flakeLockFile = "flake.lock"
+
+var (
+	defaultNixpkgsChannel = "nixos-24.05"
+	defaultStateVersion   = "24.05"
+)
+
+var (
+	channelPattern      = regexp.MustCompile(`^nixos-(\d\d\.\d\d|unstable)$`)
+	revPattern          = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	narHashPattern      = regexp.MustCompile(`^sha256-[A-Za-z0-9+/]{43}=$`)
+	stateVersionPattern = regexp.MustCompile(`^\d\d\.\d\d$`)
+)
+
+// NixpkgsSource selects the nixpkgs used by the generated flake: either a
+// channel, ie nixos-24.11, or a revision pinned by its NAR hash.
+type NixpkgsSource struct {
+	Channel      string `yaml:"channel"`
+	Rev          string `yaml:"rev"`
+	NarHash      string `yaml:"nar_hash"`
+	StateVersion string `yaml:"state_version"`
+}
+
+// readNixpkgsSource reads the nixpkgs source from path; if the file does not
+// exist, the default channel is used.
+func readNixpkgsSource(path string) (NixpkgsSource, error) {
+	var source NixpkgsSource
+
+	cleanedPath := filepath.Clean(path)
+	data, err := os.ReadFile(cleanedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return source, fmt.Errorf("failed to read %s: %v", nixpkgsFile, err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &source); err != nil {
+			return source, fmt.Errorf("failed to parse %s: %v", nixpkgsFile, err)
+		}
+	}
+
+	if source.Channel == "" && source.Rev == "" {
+		source.Channel = defaultNixpkgsChannel
+	}
+	if err := source.validate(); err != nil {
+		return source, fmt.Errorf("invalid %s: %v", nixpkgsFile, err)
+	}
+	if source.StateVersion == "" {
+		source.StateVersion = source.defaultStateVersion()
+	}
+	return source, nil
+}
+
+func (s NixpkgsSource) validate() error {
+	if s.Channel != "" && s.Rev != "" {
+		return fmt.Errorf("only one of channel and rev may be set")
+	}
+	if s.Channel != "" && !channelPattern.MatchString(s.Channel) {
+		return fmt.Errorf("channel must be of the form nixos-YY.MM or nixos-unstable, got %q", s.Channel)
+	}
+	if s.Rev != "" && !revPattern.MatchString(s.Rev) {
+		return fmt.Errorf("rev must be a full git commit hash, got %q", s.Rev)
+	}
+	if s.Rev != "" && !narHashPattern.MatchString(s.NarHash) {
+		return fmt.Errorf("a pinned rev requires a nar_hash of the form sha256-<base64>, got %q", s.NarHash)
+	}
+	if s.Rev == "" && s.NarHash != "" {
+		return fmt.Errorf("nar_hash may only be set with rev")
+	}
+	if s.StateVersion != "" && !stateVersionPattern.MatchString(s.StateVersion) {
+		return fmt.Errorf("state_version must be of the form YY.MM, got %q", s.StateVersion)
+	}
+	return nil
+}
+
+// defaultStateVersion returns the release of a channel, or the default state
+// version for nixos-unstable and pinned revisions.
+func (s NixpkgsSource) defaultStateVersion() string {
+	match := channelPattern.FindStringSubmatch(s.Channel)
+	if match != nil && match[1] != "unstable" {
+		return match[1]
+	}
+	return defaultStateVersion
+}
+
+// flakeURL returns the nixpkgs input url of the generated flake.
+func (s NixpkgsSource) flakeURL() string {
+	if s.Rev != "" {
+		return "github:nixos/nixpkgs/" + s.Rev + "?narHash=" + url.QueryEscape(s.NarHash)
+	}
+	return "github:nixos/nixpkgs/" + s.Channel
+}
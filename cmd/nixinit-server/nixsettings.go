@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// nixSettingsFile is the name of the optional file, uploaded alongside
+// configuration.nix, which carries nix settings for the remote build.
+const nixSettingsFile = "nix-settings.yaml"
+
+// NixSettings contains nix settings supplied by the client which are applied
+// only for the duration of a nixos-rebuild run; they are passed on the command
+// line and are never written to /etc/nixos.
+type NixSettings struct {
+	Substituters      []string `yaml:"substituters,omitempty"`
+	TrustedPublicKeys []string `yaml:"trusted_public_keys,omitempty"`
+	Netrc             string   `yaml:"netrc,omitempty"`
+	MaxJobs           string   `yaml:"max_jobs,omitempty"`
+	Cores             int      `yaml:"cores,omitempty"`
+}
+
+// readNixSettings reads the nix settings file at path; if the file does not
+// exist, empty settings are returned.
+func readNixSettings(path string) (NixSettings, error) {
+	var settings NixSettings
+
+	cleanedPath := filepath.Clean(path)
+	data, err := os.ReadFile(cleanedPath)
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, fmt.Errorf("failed to read nix settings file %s: %v", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("failed to parse nix settings file %s: %v", path, err)
+	}
+
+	if err := settings.validate(); err != nil {
+		return settings, fmt.Errorf("invalid nix settings in %s: %v", path, err)
+	}
+	return settings, nil
+}
+
+func (s NixSettings) validate() error {
+	if s.MaxJobs != "" && s.MaxJobs != "auto" {
+		if _, err := strconv.ParseUint(s.MaxJobs, 10, 32); err != nil {
+			return fmt.Errorf("max_jobs must be a number or \"auto\", got %q", s.MaxJobs)
+		}
+	}
+	if s.Cores < 0 {
+		return fmt.Errorf("cores must not be negative, got %d", s.Cores)
+	}
+	for _, settings := range [][]string{s.Substituters, s.TrustedPublicKeys} {
+		for _, setting := range settings {
+			if setting == "" || strings.ContainsAny(setting, " \t\n") {
+				return fmt.Errorf("substituters and trusted public keys must not be empty or contain whitespace: %q", setting)
+			}
+		}
+	}
+	return nil
+}
+
+// nixArgs converts the settings into --option arguments, which are understood
+// by nix, nixos-rebuild and nixos-install. Netrc credentials are written to a
+// private temporary file which is removed by the returned cleanup function
+// once the build has completed.
+func (s NixSettings) nixArgs() ([]string, func(), error) {
+	var args []string
+	cleanup := func() {}
+
+	if len(s.Substituters) > 0 {
+		args = append(args, "--option", "extra-substituters", strings.Join(s.Substituters, " "))
+	}
+	if len(s.TrustedPublicKeys) > 0 {
+		args = append(args, "--option", "extra-trusted-public-keys", strings.Join(s.TrustedPublicKeys, " "))
+	}
+	if s.MaxJobs != "" {
+		args = append(args, "--option", "max-jobs", s.MaxJobs)
+	}
+	if s.Cores > 0 {
+		args = append(args, "--option", "cores", strconv.Itoa(s.Cores))
+	}
+
+	if s.Netrc != "" {
+		// os.CreateTemp creates the file with 0600 permissions
+		netrcFile, err := os.CreateTemp("", "nixinit-netrc-*")
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("failed to create netrc file: %v", err)
+		}
+		cleanup = func() {
+			if err := os.Remove(netrcFile.Name()); err != nil {
+				log.Printf("Error removing netrc file: %v\n", err)
+			}
+		}
+		if _, err := netrcFile.WriteString(s.Netrc); err != nil {
+			netrcFile.Close()
+			cleanup()
+			return nil, func() {}, fmt.Errorf("failed to write netrc file: %v", err)
+		}
+		if err := netrcFile.Close(); err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("failed to close netrc file: %v", err)
+		}
+		args = append(args, "--option", "netrc-file", netrcFile.Name())
+	}
+
+	return args, cleanup, nil
+}
+
+// wipeFile overwrites the regular file at path with zeros so that credentials
+// in it, ie netrc, do not survive its removal. Symbolic links anywhere in path
+// are not followed.
+func wipeFile(path string) error {
+	file, err := openNoFollow(path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if _, err := file.Write(bytes.Repeat([]byte{0}, int(info.Size()))); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNixSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings NixSettings
+		valid    bool
+	}{
+		{"empty", NixSettings{}, true},
+		{"all settings", NixSettings{
+			Substituters:      []string{"https://cache.example.org"},
+			TrustedPublicKeys: []string{"cache.example.org-1:abc="},
+			Netrc:             "machine cache.example.org password secret\n",
+			MaxJobs:           "8",
+			Cores:             4,
+		}, true},
+		{"max jobs auto", NixSettings{MaxJobs: "auto"}, true},
+		{"max jobs not a number", NixSettings{MaxJobs: "lots"}, false},
+		{"max jobs negative", NixSettings{MaxJobs: "-1"}, false},
+		{"negative cores", NixSettings{Cores: -1}, false},
+		{"empty substituter", NixSettings{Substituters: []string{""}}, false},
+		{"substituter with whitespace", NixSettings{Substituters: []string{"https://a.org https://b.org"}}, false},
+		{"trusted key with newline", NixSettings{TrustedPublicKeys: []string{"key\n"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.settings.validate()
+			if test.valid && err != nil {
+				t.Errorf("expected settings to be valid, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected settings to be invalid")
+			}
+		})
+	}
+}
+
+func TestNixSettingsNixArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings NixSettings
+		expected []string
+	}{
+		{"empty", NixSettings{}, nil},
+		{"substituters and keys", NixSettings{
+			Substituters:      []string{"https://a.org", "https://b.org"},
+			TrustedPublicKeys: []string{"a.org-1:abc=", "b.org-1:def="},
+		}, []string{
+			"--option", "extra-substituters", "https://a.org https://b.org",
+			"--option", "extra-trusted-public-keys", "a.org-1:abc= b.org-1:def=",
+		}},
+		{"jobs and cores", NixSettings{MaxJobs: "auto", Cores: 2}, []string{
+			"--option", "max-jobs", "auto",
+			"--option", "cores", "2",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, cleanup, err := test.settings.nixArgs()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer cleanup()
+			if !reflect.DeepEqual(args, test.expected) {
+				t.Errorf("expected args %q, got %q", test.expected, args)
+			}
+		})
+	}
+}
+
+func TestNixSettingsNetrcIsRemovedAfterBuild(t *testing.T) {
+	netrc := "machine cache.example.org password secret\n"
+	args, cleanup, err := NixSettings{Netrc: netrc}.nixArgs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(args) != 3 || args[1] != "netrc-file" {
+		t.Fatalf("expected a netrc-file option, got %q", args)
+	}
+
+	netrcPath := args[2]
+	info, err := os.Stat(netrcPath)
+	if err != nil {
+		t.Fatalf("netrc file was not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected netrc file to have mode 0600, got %v", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(netrcPath); string(data) != netrc {
+		t.Errorf("expected netrc %q, got %q", netrc, data)
+	}
+
+	cleanup()
+	if _, err := os.Stat(netrcPath); !os.IsNotExist(err) {
+		t.Errorf("expected netrc file to be removed, got %v", err)
+	}
+}
+
+func TestUploadedNetrcIsWipedOnceStaged(t *testing.T) {
+	useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+
+	upload(t, client, nixSettingsFile, "netrc: |\n  machine cache.example.org password secret\n")
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+	uploadedSettings := filepath.Join(instanceUploadDirectory(testInstanceID), nixSettingsFile)
+	// keep a second link to the uploaded file to check that it was wiped and
+	// not only unlinked
+	link := filepath.Join(t.TempDir(), nixSettingsFile)
+	if err := os.Link(uploadedSettings, link); err != nil {
+		t.Fatalf("failed to link nix settings: %v", err)
+	}
+
+	if err := privileged.StageConfig(testInstanceID); err != nil {
+		t.Fatalf("failed to stage upload: %v", err)
+	}
+	if _, err := os.Stat(uploadedSettings); !os.IsNotExist(err) {
+		t.Errorf("expected the uploaded nix settings to be removed, got %v", err)
+	}
+	data, err := os.ReadFile(link)
+	if err != nil {
+		t.Fatalf("failed to read nix settings: %v", err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("expected the uploaded nix settings to be wiped, got %q", data)
+	}
+
+	settings, err := readNixSettings(filepath.Join(stagingDirectory, nixSettingsFile))
+	if err != nil || !strings.Contains(settings.Netrc, "secret") {
+		t.Errorf("expected the netrc to be staged, got %+v: %v", settings, err)
+	}
+}
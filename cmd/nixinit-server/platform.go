@@ -1,21 +1,23 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/perlogix/libdetectcloud"
+	"gopkg.in/yaml.v3"
 )
 
-
 // CloudProvider is an enum for cloud providers:
 // Amazon Web Services, Microsoft Azure, Digital Ocean
 // Google Compute Engine, OpenStack, SoftLayer, Vultr
@@ -24,6 +26,21 @@ type CloudProvider int
 
 const cidataVolumeName = "cidata"
 
+// detectedCloud is the cloud provider detected by getInstanceID; it is empty
+// if the server is not running on a known cloud.
+var detectedCloud string
+
+var cidataMountPoint = "/mnt/cidata"
+
+// UserData is the user-data section of the cloud-init configuration written by
+// the nixinit client.
+type UserData struct {
+	Description   string   `yaml:"description,omitempty"`
+	WebhookURL    string   `yaml:"webhook_url,omitempty"`
+	WebhookSecret string   `yaml:"webhook_secret,omitempty"`
+	AllowedCIDRs  []string `yaml:"allowed_cidrs,omitempty"`
+}
+
 // create enum for cloud providers
 const (
 	AWS CloudProvider = iota
@@ -245,11 +262,10 @@ func isCidataVolumeAvailable() bool {
 // }
 
 func isLabeledDeviceMounted(label string) (bool, error) {
-	file, err := os.Open("/proc/mounts")
+	mounts, err := hostFilesystem.ReadFile("/proc/mounts")
 	if err != nil {
 		return false, fmt.Errorf("error opening /proc/mounts: %v", err)
 	}
-	defer file.Close()
 
 	labelPath := fmt.Sprintf("/dev/disk/by-label/%s", label)
 	// realPath, err := filepath.EvalSymlinks(labelPath)
@@ -257,18 +273,13 @@ func isLabeledDeviceMounted(label string) (bool, error) {
 	// 	return false, fmt.Errorf("error resolving symlink: %v", err)
 	// }
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
 		if len(fields) >= 2 && fields[0] == labelPath {
 			return true, nil
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return false, fmt.Errorf("error reading /proc/mounts: %v", err)
-	}
-
 	return false, nil
 }
 
@@ -276,14 +287,14 @@ func mountBlockDevice(mountPoint, label string) error {
 	device := fmt.Sprintf("/dev/disk/by-label/%s", label)
 
 	// Create mount point if it doesn't exist
-	if err := os.MkdirAll(mountPoint, 0750); err != nil {
+	if err := hostFilesystem.MkdirAll(mountPoint, 0750); err != nil {
 		return fmt.Errorf("failed to create mount point: %v", err)
 	}
 
 	// Mount the device
 	log.Printf("attempting to mount %s to %s\n", device, mountPoint)
 	flags := syscall.MS_RDONLY | syscall.MS_NOATIME
-	if err := syscall.Mount(device, mountPoint, "iso9660", uintptr(flags), ""); err != nil {
+	if err := hostFilesystem.Mount(device, mountPoint, "iso9660", uintptr(flags), ""); err != nil {
 		return fmt.Errorf("failed to mount device: %v", err)
 	}
 
@@ -303,7 +314,7 @@ func getInstanceIDFromCidataVolume(mountPoint string) (string, error) {
 	if !isMounted {
 		// If not mounted, attempt to mount it
 		log.Printf("cidata volume is not mounting - attempting to mount...")
-		err = mountBlockDevice(mountPoint, cidataVolumeName)
+		err = privileged.MountCidata()
 		if err != nil {
 			log.Printf("Failed to mount cidata volume: %v\n", err)
 			return "", fmt.Errorf("failed to mount cidata volume: %v", err)
@@ -316,7 +327,7 @@ func getInstanceIDFromCidataVolume(mountPoint string) (string, error) {
 	// Look for the meta-data file in the cidata volume
 	metadataPath := filepath.Join(mountPoint, "meta-data")
 	cleanedPath := filepath.Clean(metadataPath) // to satisfy gosec
-	metadata, err := os.ReadFile(cleanedPath)
+	metadata, err := hostFilesystem.ReadFile(cleanedPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to read meta-data file from cidata volume: %v", err)
 	}
@@ -341,6 +352,7 @@ func getInstanceID() (string, error) {
 	// K8S Container, Container
 
 	cloud := libdetectcloud.Detect()
+	detectedCloud = cloud
 
 	if cloud != "" {
 		log.Printf("Detected cloud provider: %s\n", cloud)
@@ -363,9 +375,86 @@ func getInstanceID() (string, error) {
 		// If cidata volume is available, you might want to read an ID from it
 		// For example:
 		// return readIDFromCidataVolume()
-		mountPoint := "/mnt/cidata"
-		instanceID, err := getInstanceIDFromCidataVolume(mountPoint)
+		instanceID, err := getInstanceIDFromCidataVolume(cidataMountPoint)
 		return instanceID, err
 	}
 	return "", fmt.Errorf("unable to retrieve instance ID - No cloud-init datasource found ")
 }
+
+// defaultHostname is used as the flake attribute if the hostname cannot be
+// determined or cannot be used as an attribute name.
+const defaultHostname = "nixos"
+
+var validHostname = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+// nixSystem returns the nix system for the architecture the server runs on.
+func nixSystem() (string, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64-linux", nil
+	case "arm64":
+		return "aarch64-linux", nil
+	default:
+		return "", fmt.Errorf("unsupported architecture %s", runtime.GOARCH)
+	}
+}
+
+// flakeHostname returns the hostname of the running system, which is used as
+// the name of its configuration in the generated flake.
+func flakeHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("Error getting hostname - using %s: %v\n", defaultHostname, err)
+		return defaultHostname
+	}
+	if !validHostname.MatchString(hostname) {
+		log.Printf("Hostname %q cannot be used as a flake attribute - using %s\n", hostname, defaultHostname)
+		return defaultHostname
+	}
+	return hostname
+}
+
+// getSystemUptime returns the time since the system booted, as reported by
+// /proc/uptime.
+func getSystemUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, fmt.Errorf("error reading /proc/uptime: %v", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected contents of /proc/uptime: %q", string(data))
+	}
+
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing /proc/uptime: %v", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// getUserData reads the user-data file from the cidata volume, which is
+// mounted by getInstanceID. User data is currently only supported when running
+// from a cidata volume; on clouds, empty user data is returned.
+func getUserData() (UserData, error) {
+	var userData UserData
+	if detectedCloud != "" || !isCidataVolumeAvailable() {
+		return userData, nil
+	}
+
+	userDataPath := filepath.Join(cidataMountPoint, "user-data")
+	cleanedPath := filepath.Clean(userDataPath) // to satisfy gosec
+	data, err := hostFilesystem.ReadFile(cleanedPath)
+	if os.IsNotExist(err) {
+		return userData, nil
+	}
+	if err != nil {
+		return userData, fmt.Errorf("failed to read user-data file from cidata volume: %v", err)
+	}
+
+	if err := yaml.Unmarshal(data, &userData); err != nil {
+		return userData, fmt.Errorf("failed to parse user-data file: %v", err)
+	}
+	return userData, nil
+}
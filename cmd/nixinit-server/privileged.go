@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// stagingDirectory is the root-only directory to which an upload is copied
+// before it is applied, so that the unprivileged front end cannot modify the
+// configuration while it is being built.
+var stagingDirectory = filepath.Join(dataDirectory, stagingSubdirectory)
+
+// stagedFiles are the files copied from the upload directory when staging; the
+// secrets subdirectory is imported separately.
+var stagedFiles = []string{configurationNixFile, nixSettingsFile, diskLayoutFile, nixpkgsFile, flakeLockFile}
+
+// privilegedOperations are the only operations which require root. They are
+// either run in-process, when the server runs as root, or delegated to the
+// privileged helper over a local socket.
+type privilegedOperations interface {
+	// MountCidata mounts the cidata volume at cidataMountPoint.
+	MountCidata() error
+	// StageConfig copies the configuration uploaded for instanceID to the
+	// staging directory.
+	StageConfig(instanceID string) error
+	// Apply applies the staged configuration, returning the toplevel store path
+	// of the system which is booted after the reboot.
+	Apply(ctx context.Context) (string, error)
+}
+
+// privileged performs the privileged operations; it is replaced with a
+// helperClient if the server is started with --helper-socket.
+var privileged privilegedOperations = localPrivilegedOperations{}
+
+// localPrivilegedOperations runs the privileged operations in-process.
+type localPrivilegedOperations struct{}
+
+func (localPrivilegedOperations) MountCidata() error {
+	return mountBlockDevice(cidataMountPoint, cidataVolumeName)
+}
+
+func (localPrivilegedOperations) StageConfig(instanceID string) error {
+	if err := validateInstanceID(instanceID); err != nil {
+		return err
+	}
+	return stageUpload(instanceUploadDirectory(instanceID), stagingDirectory)
+}
+
+func (localPrivilegedOperations) Apply(ctx context.Context) (string, error) {
+	return applyConfiguration(ctx, stagingDirectory)
+}
+
+// validateInstanceID ensures that instanceID cannot be used to refer to a
+// directory outside of the uploads directory.
+func validateInstanceID(instanceID string) error {
+	if instanceID == "" || instanceID == "." || instanceID == ".." || filepath.Base(instanceID) != instanceID {
+		return fmt.Errorf("invalid instance ID %q", instanceID)
+	}
+	return nil
+}
+
+// stageUpload replaces the contents of staging with the configuration files
+// and secrets from uploadDirectory. Symbolic links are never followed as the
+// upload directory is writable by the unprivileged front end.
+func stageUpload(uploadDirectory, staging string) error {
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("failed to clear staging directory: %v", err)
+	}
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+
+	// the optional inputs only apply to the upload they were sent with, so they
+	// are removed once staged; otherwise a later upload without, say, a disk
+	// layout would pick up the stale copy and install to disk again
+	defer removeOptionalUploads(uploadDirectory)
+
+	for _, filename := range stagedFiles {
+		err := stageFile(filepath.Join(uploadDirectory, filename), filepath.Join(staging, filename))
+		if os.IsNotExist(err) && filename != configurationNixFile {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stage %s: %v", filename, err)
+		}
+	}
+
+	// secrets are moved into the staging directory and wiped from the upload
+	// directory; they are imported from there when the configuration is applied
+	if err := importSecrets(uploadDirectory, filepath.Join(staging, secretsUploadDirectory)); err != nil {
+		return fmt.Errorf("failed to stage secrets: %v", err)
+	}
+	return nil
+}
+
+// removeOptionalUploads removes the staged files other than configuration.nix
+// from uploadDirectory; failures are logged as they do not affect the apply.
+func removeOptionalUploads(uploadDirectory string) {
+	for _, filename := range stagedFiles {
+		if filename == configurationNixFile {
+			continue
+		}
+		path := filepath.Join(uploadDirectory, filename)
+		// the nix settings may carry netrc credentials
+		if filename == nixSettingsFile {
+			if err := wipeFile(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error wiping uploaded %s: %v\n", filename, err)
+			}
+		}
+		err := removeNoFollow(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing uploaded %s: %v\n", filename, err)
+		}
+	}
+}
+
+// stageFile copies src to dst, refusing to follow a symbolic link anywhere in
+// src or to copy anything other than a regular file.
+func stageFile(src, dst string) error {
+	sourceFile, err := openNoFollow(src, unix.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+
+	cleanedDst := filepath.Clean(dst)
+	destFile, err := os.OpenFile(cleanedDst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, sourceFile); err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
+
+// openNoFollow opens the absolute path one component at a time with openat,
+// refusing to follow a symbolic link at any of them. O_NOFOLLOW alone only
+// applies to the last component, and the directories in an upload can be
+// replaced with links by the unprivileged front end.
+func openNoFollow(path string, flag int) (*os.File, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("%s is not an absolute path", path)
+	}
+
+	dirfd, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/", Err: err}
+	}
+	components := strings.Split(strings.TrimPrefix(filepath.Clean(path), "/"), "/")
+	for i, component := range components {
+		componentFlag := unix.O_RDONLY | unix.O_DIRECTORY
+		if i == len(components)-1 {
+			componentFlag = flag
+		}
+		fd, err := unix.Openat(dirfd, component, componentFlag|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(dirfd)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+		dirfd = fd
+	}
+	return os.NewFile(uintptr(dirfd), path), nil
+}
+
+// readDirNoFollow lists the directory at path without following symbolic
+// links.
+func readDirNoFollow(path string) ([]os.DirEntry, error) {
+	dir, err := openNoFollow(path, unix.O_RDONLY|unix.O_DIRECTORY)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.ReadDir(-1)
+}
+
+// removeNoFollow removes the file at path, or the empty directory if it is one,
+// without following symbolic links in its parent directories.
+func removeNoFollow(path string) error {
+	parent, err := openNoFollow(filepath.Dir(path), unix.O_RDONLY|unix.O_DIRECTORY)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	return removeAt(parent, filepath.Base(path), false)
+}
+
+// removeAllNoFollow removes path and anything in it without following
+// symbolic links; a link is removed rather than the directory it points to.
+func removeAllNoFollow(path string) error {
+	parent, err := openNoFollow(filepath.Dir(path), unix.O_RDONLY|unix.O_DIRECTORY)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	err = removeAt(parent, filepath.Base(path), true)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeAt removes name from the directory parent, first removing its
+// contents if recursive is set and it is a directory.
+func removeAt(parent *os.File, name string, recursive bool) error {
+	fd := int(parent.Fd())
+	err := unix.Unlinkat(fd, name, 0)
+	if err != unix.EISDIR {
+		return pathError("remove", parent, name, err)
+	}
+
+	if recursive {
+		childfd, err := unix.Openat(fd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return pathError("open", parent, name, err)
+		}
+		child := os.NewFile(uintptr(childfd), filepath.Join(parent.Name(), name))
+		defer child.Close()
+
+		entries, err := child.ReadDir(-1)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeAt(child, entry.Name(), true); err != nil {
+				return err
+			}
+		}
+	}
+	return pathError("remove", parent, name, unix.Unlinkat(fd, name, unix.AT_REMOVEDIR))
+}
+
+// pathError wraps err, if any, with the path of name in parent.
+func pathError(op string, parent *os.File, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: filepath.Join(parent.Name(), name), Err: err}
+}
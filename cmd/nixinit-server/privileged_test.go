@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startTestHelper serves the privileged operations on a socket in a temporary
+// directory, as the helper does, returning a client for it.
+func startTestHelper(t *testing.T) helperClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := rpc.NewServer()
+	if err := server.Register(&Helper{ops: localPrivilegedOperations{}, ctx: ctx}); err != nil {
+		t.Fatalf("failed to register helper service: %v", err)
+	}
+	socketPath := filepath.Join(t.TempDir(), "helper.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		listener.Close()
+	})
+	return helperClient{socketPath: socketPath}
+}
+
+func TestHelperStagesUpload(t *testing.T) {
+	useTestEnvironment(t)
+	client := startTestHelper(t)
+	sftpClient := newTestSFTPClient(t)
+
+	configuration := "{ ... }: { }\n"
+	upload(t, sftpClient, configurationNixFile, configuration)
+	upload(t, sftpClient, filepath.Join(secretsUploadDirectory, "token"), "s3cret")
+	if err := client.StageConfig(testInstanceID); err != nil {
+		t.Fatalf("failed to stage upload: %v", err)
+	}
+
+	staged, err := os.ReadFile(filepath.Join(stagingDirectory, configurationNixFile))
+	if err != nil || string(staged) != configuration {
+		t.Errorf("expected configuration %q to be staged, got %q: %v", configuration, staged, err)
+	}
+	if _, err := os.Stat(filepath.Join(stagingDirectory, secretsUploadDirectory, "token")); err != nil {
+		t.Errorf("expected the secret to be staged: %v", err)
+	}
+
+	if err := client.StageConfig("../" + testInstanceID); err == nil {
+		t.Errorf("expected an invalid instance ID to be rejected")
+	}
+}
+
+func TestStagingDoesNotFollowSymlinks(t *testing.T) {
+	tests := []struct {
+		name string
+		// link replaces part of the instance upload directory with a link
+		// into target.
+		link func(t *testing.T, uploadDirectory, target string)
+	}{
+		{
+			name: "upload directory",
+			link: func(t *testing.T, uploadDirectory, target string) {
+				if err := os.RemoveAll(uploadDirectory); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(target, uploadDirectory); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "secrets directory",
+			link: func(t *testing.T, uploadDirectory, target string) {
+				if err := os.WriteFile(filepath.Join(uploadDirectory, configurationNixFile), []byte("{ ... }: { }\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(target, filepath.Join(uploadDirectory, secretsUploadDirectory)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "configuration file",
+			link: func(t *testing.T, uploadDirectory, target string) {
+				if err := os.Symlink(filepath.Join(target, configurationNixFile), filepath.Join(uploadDirectory, configurationNixFile)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestEnvironment(t)
+			client := startTestHelper(t)
+
+			// target holds files the front end must not be able to read or
+			// remove through the helper
+			target := t.TempDir()
+			targetFiles := []string{configurationNixFile, nixSettingsFile, "token"}
+			for _, filename := range targetFiles {
+				if err := os.WriteFile(filepath.Join(target, filename), []byte("private"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			uploadDirectory := instanceUploadDirectory(testInstanceID)
+			if err := os.MkdirAll(uploadDirectory, 0750); err != nil {
+				t.Fatal(err)
+			}
+			test.link(t, uploadDirectory, target)
+
+			if err := client.StageConfig(testInstanceID); err == nil {
+				t.Errorf("expected staging through a symbolic link to fail")
+			}
+			for _, filename := range []string{configurationNixFile, filepath.Join(secretsUploadDirectory, "token")} {
+				data, err := os.ReadFile(filepath.Join(stagingDirectory, filename))
+				if err == nil && string(data) == "private" {
+					t.Errorf("expected %s not to be staged from the link target", filename)
+				}
+			}
+			for _, filename := range targetFiles {
+				data, err := os.ReadFile(filepath.Join(target, filename))
+				if err != nil || string(data) != "private" {
+					t.Errorf("expected %s to be left alone, got %q: %v", filename, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveAllNoFollow(t *testing.T) {
+	target := t.TempDir()
+	if err := os.WriteFile(filepath.Join(target, "token"), []byte("private"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	directory := filepath.Join(t.TempDir(), "secrets")
+	if err := os.MkdirAll(filepath.Join(directory, "nested"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(directory, "nested", "token"), []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(directory, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeAllNoFollow(directory); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Lstat(directory); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", directory, err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "token")); err != nil {
+		t.Errorf("expected the target of the link to be left alone: %v", err)
+	}
+	if err := removeAllNoFollow(directory); err != nil {
+		t.Errorf("expected removing a missing directory to succeed, got %v", err)
+	}
+
+	file, err := openNoFollow(filepath.Join(target, "..", filepath.Base(target), "token"), os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("expected a path without links to be opened: %v", err)
+	}
+	file.Close()
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openNoFollow(filepath.Join(link, "token"), os.O_RDONLY); err == nil {
+		t.Errorf("expected a link in a parent directory not to be followed")
+	}
+}
+
+func TestHelperReportsValidationFailures(t *testing.T) {
+	fake := useTestEnvironment(t)
+	privileged = startTestHelper(t)
+	client := newTestSFTPClient(t)
+	startTestWatcher(t)
+
+	// the helper exports no metrics, so the rejection is counted by the front
+	// end from the reason returned by the helper
+	failures := validationFailuresTotal.WithLabelValues("nix_settings")
+	before := testutil.ToFloat64(failures)
+	upload(t, client, nixSettingsFile, "max_jobs: lots\n")
+	upload(t, client, configurationNixFile, "{ ... }: { }\n")
+	waitForState(t, NixinitError)
+
+	if counted := testutil.ToFloat64(failures) - before; counted != 1 {
+		t.Errorf("expected 1 validation failure to be counted, got %v", counted)
+	}
+	if calls := fake.recordedCalls(); len(calls) != 0 {
+		t.Errorf("expected no commands to be run, got %v", calls)
+	}
+}
+
+// blockingOperations applies a configuration by waiting for the apply to be
+// cancelled, counting the configurations staged.
+type blockingOperations struct {
+	localPrivilegedOperations
+	staged int
+}
+
+func (o *blockingOperations) StageConfig(instanceID string) error {
+	o.staged++
+	return nil
+}
+
+func (o *blockingOperations) Apply(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestHelperDoesNotStageDuringApply(t *testing.T) {
+	ops := &blockingOperations{}
+	helper := &Helper{ops: ops, ctx: context.Background()}
+
+	done := make(chan error)
+	go func() {
+		done <- helper.Apply(Empty{}, &ApplyReply{})
+	}()
+	for applying := false; !applying; {
+		helper.mutex.Lock()
+		applying = helper.cancel != nil
+		helper.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := helper.StageConfig(StageConfigArgs{InstanceID: testInstanceID}, &Empty{}); err == nil {
+		t.Errorf("expected staging to fail while a configuration is being applied")
+	}
+	if err := helper.Cancel(Empty{}, &Empty{}); err != nil {
+		t.Fatalf("failed to cancel apply: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error from apply: %v", err)
+	}
+
+	if err := helper.StageConfig(StageConfigArgs{InstanceID: testInstanceID}, &Empty{}); err != nil {
+		t.Errorf("expected staging to succeed once the apply completed: %v", err)
+	}
+	if ops.staged != 1 {
+		t.Errorf("expected 1 configuration to be staged, got %d", ops.staged)
+	}
+}
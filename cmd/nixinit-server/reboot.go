@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rebootDelay is the time between a configuration being applied and the
+// reboot into it, which gives the client time to read the expected toplevel.
+var rebootDelay = 30 * time.Second
+
+// nixStoreDirectory is the prefix of every system toplevel path.
+const nixStoreDirectory = "/nix/store/"
+
+// resolveToplevel returns the store path of the default system generation of
+// the system rooted at root, ie / or /mnt when installing. Links are resolved
+// by hand so that the result is the path as seen from within that system.
+func resolveToplevel(root string) (string, error) {
+	link := filepath.Join(root, systemProfile)
+	// the profile links to system-<generation>-link, which links to the store
+	for i := 0; i < 2; i++ {
+		target, err := hostFilesystem.Readlink(link)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", link, err)
+		}
+		if strings.HasPrefix(target, nixStoreDirectory) {
+			return target, nil
+		}
+		if filepath.IsAbs(target) {
+			link = filepath.Join(root, target)
+		} else {
+			link = filepath.Join(filepath.Dir(link), target)
+		}
+	}
+	return "", fmt.Errorf("system profile %s does not resolve to the nix store", filepath.Join(root, systemProfile))
+}
+
+// scheduleReboot asks systemd to reboot once rebootDelay has passed; the reboot
+// happens even if the server exits in the meantime.
+func scheduleReboot(ctx context.Context) error {
+	log.Printf("Rebooting in %v...\n", rebootDelay)
+	onActive := fmt.Sprintf("--on-active=%ds", int(rebootDelay.Seconds()))
+	if err := runCommand(ctx, "systemd-run", onActive, "systemctl", "reboot"); err != nil {
+		return fmt.Errorf("error scheduling reboot: %v", err)
+	}
+	return nil
+}
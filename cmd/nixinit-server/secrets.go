@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// secretsUploadDirectory is the subdirectory of the instance upload directory
+// to which secrets are uploaded, ie /uploads/nixinit/<instance-id>/secrets.
+const secretsUploadDirectory = "secrets"
+
+// secretsDirectory is the root-only location to which uploaded secrets are
+// moved; it is never copied into /etc/nixos so secrets do not end up in the
+// nix store.
+var secretsDirectory = filepath.Join(dataDirectory, secretsSubdirectory)
+
+// isSecretsPath returns true if path (relative to the sftp root) is within the
+// secrets upload directory of an instance; secrets can be written but cannot
+// be read back or listed over sftp.
+func isSecretsPath(path string) bool {
+	relativePath := strings.TrimPrefix(filepath.Clean(path), nixinitDirectory+"/")
+	directories := strings.Split(relativePath, "/")
+	return len(directories) > 1 && directories[1] == secretsUploadDirectory
+}
+
+// importSecrets moves the files uploaded to the secrets directory of
+// uploadDirectory into destination and then wipes the uploaded secrets. Only
+// regular files are imported; anything else is discarded.
+func importSecrets(uploadDirectory, destination string) error {
+	uploadedSecretsDirectory := filepath.Join(uploadDirectory, secretsUploadDirectory)
+	entries, err := readDirNoFollow(uploadedSecretsDirectory)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read secrets directory: %v", err)
+	}
+
+	// always remove the uploaded secrets, even if the import fails part way
+	defer func() {
+		if err := removeAllNoFollow(uploadedSecretsDirectory); err != nil {
+			log.Printf("Error removing uploaded secrets: %v\n", err)
+		}
+	}()
+
+	if err := os.MkdirAll(destination, 0700); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %v", err)
+	}
+	// MkdirAll does not change the permissions of an existing directory
+	if err := os.Chmod(destination, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions on secrets directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if isPartialUpload(entry.Name()) {
+			log.Printf("Ignoring %s in secrets upload - the upload has not completed\n", entry.Name())
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			log.Printf("Ignoring %s in secrets upload - only regular files are supported\n", entry.Name())
+			continue
+		}
+
+		src := filepath.Join(uploadedSecretsDirectory, entry.Name())
+		dst := filepath.Join(destination, entry.Name())
+		if err := importSecret(src, dst); err != nil {
+			return fmt.Errorf("failed to import secret %s: %v", entry.Name(), err)
+		}
+		log.Printf("Imported secret %s\n", entry.Name())
+	}
+
+	return nil
+}
+
+// importSecret copies src to dst, readable only by its owner; the copy is
+// written to a temporary file and renamed so dst never holds a partial secret.
+// Symbolic links anywhere in src are not followed.
+func importSecret(src, dst string) error {
+	sourceFile, err := openNoFollow(src, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	// os.CreateTemp creates the file with 0600 permissions
+	tempFile, err := os.CreateTemp(filepath.Dir(dst), ".import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := io.Copy(tempFile, sourceFile); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tempFile.Name(), 0400); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), dst)
+}
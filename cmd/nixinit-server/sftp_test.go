@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// startTestSSHServer serves the ssh server on a local port until the test
+// completes, returning its address.
+func startTestSSHServer(t *testing.T) string {
+	t.Helper()
+
+	previousGuard := guard
+	guard = newAbuseGuard(nil)
+	t.Cleanup(func() { guard = previousGuard })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := newSSHServer(listener.Addr().String())
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String()
+}
+
+// dialTestSSHServer connects to the ssh server at addr as user with a newly
+// generated key.
+func dialTestSSHServer(t *testing.T, addr, user string) (*gossh.Client, error) {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	config := &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+	return gossh.Dial("tcp", addr, config)
+}
+
+// newTestSFTPClient returns an sftp client connected to a newly started ssh
+// server.
+func newTestSFTPClient(t *testing.T) *sftp.Client {
+	t.Helper()
+
+	addr := startTestSSHServer(t)
+	client, err := dialTestSSHServer(t, addr, validUser)
+	if err != nil {
+		t.Fatalf("failed to connect to ssh server: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatalf("failed to start sftp session: %v", err)
+	}
+	t.Cleanup(func() { sftpClient.Close() })
+	return sftpClient
+}
+
+func writeRemoteFile(t *testing.T, client *sftp.Client, remotePath, data string) error {
+	t.Helper()
+
+	file, err := client.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write([]byte(data)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func TestSFTPUploadIsStoredInDataDirectory(t *testing.T) {
+	useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+
+	remoteDirectory := path.Join(nixinitDirectory, testInstanceID)
+	configuration := "{ ... }: { }\n"
+	if err := writeRemoteFile(t, client, path.Join(remoteDirectory, configurationNixFile), configuration); err != nil {
+		t.Fatalf("failed to upload configuration: %v", err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(instanceUploadDirectory(testInstanceID), configurationNixFile))
+	if err != nil {
+		t.Fatalf("upload was not stored in the data directory: %v", err)
+	}
+	if string(stored) != configuration {
+		t.Errorf("expected %q to be stored, got %q", configuration, stored)
+	}
+
+	file, err := client.Open(path.Join(remoteDirectory, configurationNixFile))
+	if err != nil {
+		t.Fatalf("failed to open uploaded configuration: %v", err)
+	}
+	downloaded, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to read uploaded configuration: %v", err)
+	}
+	if string(downloaded) != configuration {
+		t.Errorf("expected to read back %q, got %q", configuration, downloaded)
+	}
+
+	entries, err := client.ReadDir(remoteDirectory)
+	if err != nil {
+		t.Fatalf("failed to list upload directory: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != configurationNixFile {
+		t.Errorf("expected upload directory to contain only %s, got %v", configurationNixFile, entries)
+	}
+
+	renamed := path.Join(remoteDirectory, "configuration.nix.old")
+	if err := client.Rename(path.Join(remoteDirectory, configurationNixFile), renamed); err != nil {
+		t.Fatalf("failed to rename uploaded configuration: %v", err)
+	}
+	if err := client.Remove(renamed); err != nil {
+		t.Fatalf("failed to remove uploaded configuration: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(instanceUploadDirectory(testInstanceID), "configuration.nix.old")); !os.IsNotExist(err) {
+		t.Errorf("expected renamed configuration to be removed, got %v", err)
+	}
+}
+
+func TestSFTPUploadIsRenamedIntoPlaceOnceComplete(t *testing.T) {
+	useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+
+	remotePath := path.Join(nixinitDirectory, testInstanceID, configurationNixFile)
+	localPath := filepath.Join(instanceUploadDirectory(testInstanceID), configurationNixFile)
+	file, err := client.Create(remotePath)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", remotePath, err)
+	}
+	if _, err := file.Write([]byte("{ ... }: { }\n")); err != nil {
+		t.Fatalf("failed to write %s: %v", remotePath, err)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("expected the upload not to be in place before it is closed, got %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("failed to close %s: %v", remotePath, err)
+	}
+	if data, err := os.ReadFile(localPath); err != nil || string(data) != "{ ... }: { }\n" {
+		t.Errorf("expected the upload to be in place once closed, got %q: %v", data, err)
+	}
+}
+
+func TestSFTPInterruptedUploadIsDiscarded(t *testing.T) {
+	useTestEnvironment(t)
+	addr := startTestSSHServer(t)
+	sshClient, err := dialTestSSHServer(t, addr, validUser)
+	if err != nil {
+		t.Fatalf("failed to connect to ssh server: %v", err)
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		t.Fatalf("failed to start sftp session: %v", err)
+	}
+
+	uploadDirectory := instanceUploadDirectory(testInstanceID)
+	file, err := client.Create(path.Join(nixinitDirectory, testInstanceID, configurationNixFile))
+	if err != nil {
+		t.Fatalf("failed to create configuration: %v", err)
+	}
+	if _, err := file.Write([]byte("{ ... }: {")); err != nil {
+		t.Fatalf("failed to write configuration: %v", err)
+	}
+	// the connection drops before the file is closed
+	client.Close()
+	sshClient.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(uploadDirectory)
+		if err != nil {
+			t.Fatalf("failed to read upload directory: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the interrupted upload to be discarded, found %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSFTPAccessOutsideUploadsIsDenied(t *testing.T) {
+	useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+
+	if err := writeRemoteFile(t, client, "/etc/passwd", "root::0:0::/:/bin/sh\n"); err == nil {
+		t.Errorf("expected upload outside of %s to be denied", nixinitDirectory)
+	}
+	if _, err := client.Open("/etc/passwd"); err == nil {
+		t.Errorf("expected download outside of %s to be denied", nixinitDirectory)
+	}
+}
+
+func TestSFTPSecretsCannotBeReadBack(t *testing.T) {
+	useTestEnvironment(t)
+	client := newTestSFTPClient(t)
+
+	remoteSecretsDirectory := path.Join(nixinitDirectory, testInstanceID, secretsUploadDirectory)
+	secret := path.Join(remoteSecretsDirectory, "token")
+	if err := writeRemoteFile(t, client, secret, "s3cret"); err != nil {
+		t.Fatalf("failed to upload secret: %v", err)
+	}
+
+	if _, err := client.Open(secret); err == nil {
+		t.Errorf("expected reading a secret to be denied")
+	}
+	if _, err := client.ReadDir(remoteSecretsDirectory); err == nil {
+		t.Errorf("expected listing secrets to be denied")
+	}
+	if err := client.Rename(secret, path.Join(nixinitDirectory, testInstanceID, "token")); err == nil {
+		t.Errorf("expected moving a secret out of the secrets directory to be denied")
+	}
+}
+
+func TestSSHSessionReportsStatus(t *testing.T) {
+	useTestEnvironment(t)
+	previousInstanceID := serverInstanceID
+	serverInstanceID = testInstanceID
+	t.Cleanup(func() { serverInstanceID = previousInstanceID })
+	addr := startTestSSHServer(t)
+
+	client, err := dialTestSSHServer(t, addr, validUser)
+	if err != nil {
+		t.Fatalf("failed to connect to ssh server: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	output, err := session.Output("--format json")
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	var response responseParams
+	if err := json.Unmarshal(output, &response); err != nil {
+		t.Fatalf("failed to parse response %q: %v", output, err)
+	}
+	if response.ServerStatus != WaitingForNixConfig.String() {
+		t.Errorf("expected status %v, got %v", WaitingForNixConfig, response.ServerStatus)
+	}
+}
+
+func TestInvalidUserIsRejected(t *testing.T) {
+	useTestEnvironment(t)
+	addr := startTestSSHServer(t)
+
+	rejections := authRejectionsTotal.WithLabelValues("invalid_user")
+	before := testutil.ToFloat64(rejections)
+	client, err := dialTestSSHServer(t, addr, "root")
+	if err == nil {
+		client.Close()
+		t.Fatalf("expected login as root to be rejected")
+	}
+	if counted := testutil.ToFloat64(rejections) - before; counted != 1 {
+		t.Errorf("expected the rejection to be counted once, got %v", counted)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+	"github.com/gliderlabs/ssh"
+	"github.com/pterm/pterm"
+)
+
+// shutdownTimeout bounds each phase of shutdown: draining ssh sessions, waiting
+// for an in-flight apply before it is cancelled and delivering webhook events.
+// Each phase has its own deadline so that a slow phase does not cut short the
+// next.
+var shutdownTimeout = 30 * time.Second
+
+var (
+	// applyContext is cancelled if an apply is still running when the
+	// shutdown timeout expires.
+	applyContext, cancelApply = context.WithCancel(context.Background())
+	applies                   applyTracker
+)
+
+// applyTracker tracks in-flight applies so that shutdown can wait for them;
+// once stopping, no new applies are started.
+type applyTracker struct {
+	mutex    sync.Mutex
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+// begin registers a new apply, returning false if the server is stopping.
+func (t *applyTracker) begin() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopping {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *applyTracker) end() {
+	t.wg.Done()
+}
+
+// stop prevents new applies from starting and waits for in-flight applies to
+// finish, returning false if ctx expires first.
+func (t *applyTracker) stop(ctx context.Context) bool {
+	t.mutex.Lock()
+	t.stopping = true
+	t.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notifySystemd sends state to systemd if the server is run as a Type=notify
+// service; it does nothing otherwise.
+func notifySystemd(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.Printf("Error notifying systemd: %v\n", err)
+	}
+}
+
+// runWatchdog pings the systemd watchdog at half the configured interval until
+// ctx is done; it returns immediately if the watchdog is not enabled.
+func runWatchdog(ctx context.Context) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.Printf("Error checking systemd watchdog: %v\n", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notifySystemd(daemon.SdNotifyWatchdog)
+		}
+	}
+}
+
+// gracefulShutdown drains ssh sessions, waits for (or cancels) an in-flight
+// apply, delivers outstanding webhook events and flushes logs.
+func gracefulShutdown(server *ssh.Server) {
+	pterm.Info.Println("Shutting down nixinit-server...")
+	setState(ShuttingDown, nil)
+	notifySystemd(daemon.SdNotifyStopping)
+
+	withShutdownTimeout(func(ctx context.Context) {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Timed out draining ssh sessions - closing them: %v\n", err)
+			if err := server.Close(); err != nil {
+				log.Printf("Error closing ssh server: %v\n", err)
+			}
+		}
+	})
+
+	withShutdownTimeout(func(ctx context.Context) {
+		if !applies.stop(ctx) {
+			log.Printf("Timed out waiting for configuration to be applied - cancelling...\n")
+			cancelApply()
+			applies.stop(context.Background())
+		}
+	})
+
+	if notifier != nil {
+		withShutdownTimeout(notifier.stop)
+	}
+
+	_ = os.Stdout.Sync()
+	_ = os.Stderr.Sync()
+	pterm.Info.Println("nixinit-server stopped")
+}
+
+// withShutdownTimeout runs a phase of shutdown with its own deadline.
+func withShutdownTimeout(phase func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	phase(ctx)
+}
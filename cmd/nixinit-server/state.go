@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// stateMutex protects currentState, lastError, lastApplyResult,
+	// lastApplyUpload, uploadSequence, expectedToplevel and shutdownDeadline,
+	// which are updated by the file watcher, sftp and shutdown handlers and
+	// read by the ssh and http handlers.
+	stateMutex       sync.RWMutex
+	lastError        string
+	lastApplyResult  string
+	expectedToplevel string
+	shutdownDeadline time.Time
+	startTime        = time.Now()
+
+	// uploadSequence numbers the configurations uploaded over sftp, and
+	// lastApplyUpload is the number of the upload which lastApplyResult
+	// belongs to, so that a client can tell the result of its own upload.
+	uploadSequence  int64
+	lastApplyUpload int64
+
+	// serverInstanceID is the instance ID determined at startup.
+	serverInstanceID string
+)
+
+// stateSnapshot is a consistent view of the mutable server state.
+type stateSnapshot struct {
+	State            NixInitState
+	LastError        string
+	LastApplyResult  string
+	LastApplyUpload  int64
+	UploadSequence   int64
+	ExpectedToplevel string
+	ShutdownDeadline time.Time
+}
+
+// setState transitions the server to state; if err is not nil it is recorded
+// as the last error.
+func setState(state NixInitState, err error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if state != currentState {
+		log.Printf("State transition: %v -> %v\n", currentState, state)
+		notifyState(state, err)
+		notifySystemd("STATUS=" + state.String())
+	}
+	currentState = state
+	recordState(state)
+	if err != nil {
+		lastError = err.Error()
+	}
+}
+
+// getState returns the current state of the server and the last error
+// recorded, if any.
+func getState() (NixInitState, string) {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+	return currentState, lastError
+}
+
+// getStateSnapshot returns a consistent view of the mutable server state.
+func getStateSnapshot() stateSnapshot {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+	return stateSnapshot{
+		State:            currentState,
+		LastError:        lastError,
+		LastApplyResult:  lastApplyResult,
+		LastApplyUpload:  lastApplyUpload,
+		UploadSequence:   uploadSequence,
+		ExpectedToplevel: expectedToplevel,
+		ShutdownDeadline: shutdownDeadline,
+	}
+}
+
+// recordUpload records the completion of an upload of configuration.nix,
+// returning its number.
+func recordUpload() int64 {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	uploadSequence++
+	return uploadSequence
+}
+
+// getUploadSequence returns the number of the most recent upload of
+// configuration.nix.
+func getUploadSequence() int64 {
+	stateMutex.RLock()
+	defer stateMutex.RUnlock()
+	return uploadSequence
+}
+
+// recordApplyResult records the outcome of the most recent attempt to apply a
+// configuration, which was that of upload.
+func recordApplyResult(upload int64, err error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	lastApplyUpload = upload
+	now := time.Now().Format(time.RFC3339)
+	if err != nil {
+		lastApplyResult = fmt.Sprintf("failed at %s: %v", now, err)
+		return
+	}
+	lastApplyResult = fmt.Sprintf("succeeded at %s", now)
+}
+
+// setExpectedToplevel records the toplevel store path of the system which is
+// booted after the reboot.
+func setExpectedToplevel(toplevel string) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	expectedToplevel = toplevel
+}
+
+func setShutdownDeadline(deadline time.Time) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	shutdownDeadline = deadline
+}
+
+// isReadyForConfig returns true if the server is in a state in which it
+// accepts a new configuration.
+func isReadyForConfig(state NixInitState) bool {
+	return state == WaitingForNixConfig || state == NixinitError
+}
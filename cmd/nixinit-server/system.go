@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// executor runs the external commands used to apply a configuration; it is
+// replaced in tests so that the apply flow can run without nix.
+type executor interface {
+	// Run runs name with args in dir (the current directory if empty),
+	// returning its stdout and stderr.
+	Run(ctx context.Context, dir, name string, args ...string) (stdout, stderr []byte, err error)
+}
+
+// filesystem is used for the operations on the host system - mounting the
+// cidata volume, reading from it and /proc, writing /etc/nixos and resolving
+// the system profile; it is replaced in tests so that they do not need root.
+type filesystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Readlink(name string) (string, error)
+	Mount(source, target, fstype string, flags uintptr, data string) error
+}
+
+var (
+	commandExecutor executor   = osExecutor{}
+	hostFilesystem  filesystem = osFilesystem{}
+)
+
+// osExecutor runs commands with os/exec.
+type osExecutor struct{}
+
+func (osExecutor) Run(ctx context.Context, dir, name string, args ...string) ([]byte, []byte, error) {
+	cmd := newCommand(ctx, name, args...)
+	cmd.Dir = dir
+
+	var out bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	return out.Bytes(), stderr.Bytes(), err
+}
+
+// osFilesystem operates on the real filesystem.
+type osFilesystem struct{}
+
+func (osFilesystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFilesystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFilesystem) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFilesystem) Mount(source, target, fstype string, flags uintptr, data string) error {
+	return syscall.Mount(source, target, fstype, flags, data)
+}
+
+// newCommand returns a command which is sent SIGTERM, and killed if it has not
+// exited after a grace period, when ctx is cancelled.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 10 * time.Second
+	return cmd
+}
+
+// runCommand runs the named command, returning its stderr in the error if it
+// fails.
+func runCommand(ctx context.Context, name string, args ...string) error {
+	return runCommandInDirectory(ctx, "", name, args...)
+}
+
+// runCommandInDirectory runs the named command in dir; its output is added to
+// the apply log.
+func runCommandInDirectory(ctx context.Context, dir, name string, args ...string) error {
+	log.Printf("Running %s...\n", name)
+	out, stderr, err := commandExecutor.Run(ctx, dir, name, args...)
+	appendApplyLog(name, args, out, stderr)
+	if err != nil {
+		return fmt.Errorf("error running %s: %v, stderr: %s", name, err, stderr)
+	}
+
+	log.Printf("%s complete: %s\n", name, out)
+	return nil
+}
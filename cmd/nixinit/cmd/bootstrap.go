@@ -2,7 +2,12 @@
 package cmd
 
 import (
+	"context"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -10,16 +15,38 @@ import (
 // bootstrapCmd represents the bootstrap command
 var bootstrapCmd = &cobra.Command{
 	Use:   "bootstrap",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "launches a bootstrap nixos instance in libvirt",
+	Long: `bootstrap launches a bootstrap nixos VM running nixinit-server in the local
+libvirt daemon.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+The VM can be described in a YAML profile file passed with --profile; flags set
+on the command line override the values in the file. For example:
+
+  name: nixinit-builder
+  arch: x86_64
+  memory: 16384    # MiB
+  vcpus: 8
+  disk_size: 50    # GiB
+  network: default`,
 	Run: bootstrap,
 }
 
+var (
+	webhookURL    string
+	webhookSecret string
+	allowedCIDRs  []string
+	// bootstrapFlags holds the values of the VM flags; only those set on the
+	// command line override the profile file.
+	bootstrapFlags  BootstrapProfile
+	profileFilename string
+	// keepOnFailure keeps the resources created by a failed launch for
+	// debugging rather than removing them.
+	keepOnFailure bool
+	// imageFile is a local qcow2 file uploaded as the base image if it is not
+	// already in the nixinit-volume pool.
+	imageFile string
+)
+
 func init() {
 	rootCmd.AddCommand(bootstrapCmd)
 
@@ -32,12 +59,89 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// bootstrapCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	bootstrapCmd.Flags().StringVar(&webhookURL, "webhook-url", "", "URL to which the bootstrap instance posts state change events")
+	bootstrapCmd.Flags().StringVar(&webhookSecret, "webhook-secret", "", "Secret used to sign webhook events (HMAC-SHA256)")
+	bootstrapCmd.Flags().BoolVar(&keepOnFailure, "keep-on-failure", false, "Keep the resources created by a failed launch for debugging")
+	bootstrapCmd.Flags().StringVar(&profileFilename, "profile", "", "YAML file describing the bootstrap VM; flags override its values")
+	bootstrapCmd.Flags().StringVar(&bootstrapFlags.Name, "name", "", "Name of the bootstrap VM (default: nixinit-<instance ID prefix>)")
+	bootstrapCmd.Flags().StringVar(&bootstrapFlags.Arch, "arch", defaultBootstrapProfile.Arch, "Architecture of the bootstrap instance (x86_64 or aarch64)")
+	bootstrapCmd.Flags().Uint64Var(&bootstrapFlags.Memory, "memory", defaultBootstrapProfile.Memory, "Memory of the bootstrap VM in MiB")
+	bootstrapCmd.Flags().UintVar(&bootstrapFlags.VCPUs, "vcpus", defaultBootstrapProfile.VCPUs, "Number of vCPUs of the bootstrap VM")
+	bootstrapCmd.Flags().Uint64Var(&bootstrapFlags.DiskSize, "disk-size", defaultBootstrapProfile.DiskSize, "Disk size of the bootstrap VM in GiB")
+	bootstrapCmd.Flags().StringVar(&bootstrapFlags.Image, "image", "", "Base image in the nixinit-volume pool (default: the bootstrap image for the architecture)")
+	bootstrapCmd.Flags().StringVar(&imageFile, "image-file", "", "Local qcow2 file to upload as the base image if it is not already in the nixinit-volume pool")
+	bootstrapCmd.Flags().StringVar(&bootstrapFlags.Network, "network", defaultBootstrapProfile.Network, "libvirt network to attach the bootstrap VM to")
+	bootstrapCmd.Flags().StringVar(&bootstrapFlags.Machine, "machine", "", "Machine type of the bootstrap VM (default: the machine type for the architecture)")
+	bootstrapCmd.Flags().StringSliceVar(&allowedCIDRs, "allowed-cidr", nil, "Only accept ssh connections to the bootstrap instance from this CIDR (can be repeated)")
+}
+
+// getBootstrapProfile combines the flags set on the command line, the profile
+// file and the defaults, in that order of precedence, and validates the result.
+func getBootstrapProfile(cmd *cobra.Command) (BootstrapProfile, error) {
+	profile := bootstrapFlags.changedFlags(cmd.Flags().Changed)
+	if profileFilename != "" {
+		fileProfile, err := readBootstrapProfile(profileFilename)
+		if err != nil {
+			return profile, err
+		}
+		profile = profile.merge(fileProfile)
+	}
+	profile = profile.merge(defaultBootstrapProfile)
+	return profile, profile.validate()
 }
 
 func bootstrap(cmd *cobra.Command, args []string) {
 	log.Printf("Bootstrapping locally...")
 
-	err := launchLibvirtInstance("nixinit-bootstrap.qcow2", "nixinit", 4096, 2)
+	if webhookSecret != "" && webhookURL == "" {
+		log.Printf("--webhook-secret requires --webhook-url")
+		return
+	}
+
+	profile, err := getBootstrapProfile(cmd)
+	if err != nil {
+		log.Printf("Invalid bootstrap VM: %v", err)
+		return
+	}
+
+	if imageFile != "" {
+		if err := checkQcow2File(imageFile); err != nil {
+			log.Printf("Invalid --image-file: %v", err)
+			return
+		}
+	}
+
+	for _, cidr := range allowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			log.Printf("Invalid --allowed-cidr %q: %v", cidr, err)
+			return
+		}
+	}
+
+	userData := UserData{
+		WebhookURL:    webhookURL,
+		WebhookSecret: webhookSecret,
+		AllowedCIDRs:  allowedCIDRs,
+	}
+	l, err := connectLibvirt()
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	defer l.Disconnect()
+	log.Printf("Connected to libvirt at %s", libvirtURI)
+
+	if err := checkLibvirtSetup(l, profile.Network); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	// on Ctrl-C the launch is cancelled and rolled back; further signals are
+	// ignored so that the rollback is not interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = launchLibvirtInstance(ctx, l, profile, userData)
 	if err != nil {
 		log.Printf("Error launching bootstrap VM: %v", err)
 	}
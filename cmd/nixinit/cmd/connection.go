@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// libvirtURI is the libvirt connection URI set with --connect, ie
+// qemu:///system, qemu:///session, qemu+ssh://user@host/system or
+// qemu+tcp://host/system.
+var libvirtURI string
+
+// defaultLibvirtURI returns the URI used if --connect is not given: the value
+// of LIBVIRT_DEFAULT_URI, as with virsh, or the local system daemon.
+func defaultLibvirtURI() string {
+	if uri := os.Getenv("LIBVIRT_DEFAULT_URI"); uri != "" {
+		return uri
+	}
+	return string(libvirt.QEMUSystem)
+}
+
+// parseLibvirtURI parses a libvirt connection URI. go-libvirt connects to the
+// system daemon's socket for local URIs, so the socket of the session daemon
+// is added to local session URIs.
+func parseLibvirtURI(rawURI string) (*url.URL, error) {
+	uri, err := url.Parse(rawURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid libvirt URI %q: %v", rawURI, err)
+	}
+	if uri.Scheme == "" {
+		return nil, fmt.Errorf("invalid libvirt URI %q: no driver, ie qemu:///system", rawURI)
+	}
+
+	local := (!strings.Contains(uri.Scheme, "+") && uri.Host == "") || strings.HasSuffix(uri.Scheme, "+unix")
+	if local && uri.Path == "/session" && uri.Query().Get("socket") == "" {
+		runtimeDirectory := os.Getenv("XDG_RUNTIME_DIR")
+		if runtimeDirectory == "" {
+			return nil, fmt.Errorf("XDG_RUNTIME_DIR must be set to connect to %s", rawURI)
+		}
+		query := uri.Query()
+		query.Set("socket", filepath.Join(runtimeDirectory, "libvirt", "libvirt-sock"))
+		uri.RawQuery = query.Encode()
+	}
+	return uri, nil
+}
+
+// connectLibvirt opens the connection to libvirt used by a command; it is
+// passed to every helper which talks to libvirt.
+func connectLibvirt() (*libvirt.Libvirt, error) {
+	uri, err := parseLibvirtURI(libvirtURI)
+	if err != nil {
+		return nil, err
+	}
+	l, err := libvirt.ConnectToURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to libvirt at %s: %v", libvirtURI, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,30 @@
+package cmd
+
+import "testing"
+
+func TestParseLibvirtURI(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+
+	tests := map[string]string{
+		"qemu:///system":                 "qemu:///system",
+		"qemu:///session":                "qemu:///session?socket=%2Frun%2Fuser%2F1000%2Flibvirt%2Flibvirt-sock",
+		"qemu+ssh://admin@lab/system":    "qemu+ssh://admin@lab/system",
+		"qemu+tcp://lab:16509/system":    "qemu+tcp://lab:16509/system",
+		"qemu+ssh://admin@lab/session":   "qemu+ssh://admin@lab/session",
+		"qemu:///session?socket=/s.sock": "qemu:///session?socket=/s.sock",
+	}
+	for raw, expected := range tests {
+		uri, err := parseLibvirtURI(raw)
+		if err != nil {
+			t.Errorf("unexpected error parsing %s: %v", raw, err)
+			continue
+		}
+		if uri.String() != expected {
+			t.Errorf("expected %s to be parsed as %s, got %s", raw, expected, uri)
+		}
+	}
+
+	if _, err := parseLibvirtURI("lab.example.com"); err == nil {
+		t.Errorf("expected a URI without a driver to be rejected")
+	}
+}
@@ -29,7 +29,6 @@ var generateConfigCmd = &cobra.Command{
 
 var (
 	configurationNixFilename = "configuration.nix"
-	defaultNixOSStateVersion = "24.05"
 )
 
 var configurationNixTemplate = `
@@ -94,6 +93,8 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// generateConfigCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	generateConfigCmd.Flags().StringVar(&nixpkgsChannel, "nixpkgs-channel", "", "nixpkgs channel the configuration is built with; sets system.stateVersion (default "+defaultNixpkgsChannel+")")
+	generateConfigCmd.Flags().StringVar(&stateVersion, "state-version", "", "system.stateVersion of the configuration (default: the release of the channel)")
 }
 
 func generateConfig(cmd *cobra.Command, args []string) {
@@ -105,13 +106,22 @@ func generateConfig(cmd *cobra.Command, args []string) {
 	}
 	pterm.Info.Println("configuration.nix does not exist. Creating...")
 
+	if nixpkgsChannel != "" && !nixosChannelPattern.MatchString(nixpkgsChannel) {
+		pterm.Error.Printf("--nixpkgs-channel must be of the form nixos-YY.MM or nixos-unstable - exiting...\n")
+		return
+	}
+	nixosStateVersion := stateVersion
+	if nixosStateVersion == "" {
+		nixosStateVersion = stateVersionForChannel(nixpkgsChannel)
+	}
+
 	hostname, err := pterm.DefaultInteractiveTextInput.Show("Enter hostname")
 	sshPublicKey, err := pterm.DefaultInteractiveTextInput.Show("Enter SSH public key")
 
 	nixosConfigParams := NixConfigurationParams{
 		Hostname:          hostname,
 		SSHPublicKey:      sshPublicKey,
-		NixOSStateVersion: defaultNixOSStateVersion,
+		NixOSStateVersion: nixosStateVersion,
 	}
 
 	// render the template with the provided parameters using the go tmpl library
@@ -0,0 +1,471 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+const (
+	defaultImageMirrorURL = "https://pub-5e2d0f66ccb2405aa99e1cea5de9f473.r2.dev"
+	// imageManifestName is the file on the mirror listing the sha256 of each
+	// image, in the format written by sha256sum.
+	imageManifestName = "SHA256SUMS"
+	// imageSignatureName is the ed25519 signature of the manifest, raw or
+	// base64 encoded; it is only checked if a public key is configured.
+	imageSignatureName = "SHA256SUMS.sig"
+	partialImageSuffix = ".partial"
+)
+
+var (
+	// imageMirrorURL is the base URL from which bootstrap images and their
+	// manifest are downloaded.
+	imageMirrorURL string
+	// imagePublicKey is the base64 encoded ed25519 key with which the manifest
+	// is signed; if empty, the signature is not checked.
+	imagePublicKey string
+	// imageOffline restricts the image cache to the images already in it.
+	imageOffline bool
+)
+
+// defaultImageMirror returns the mirror used if --image-mirror is not given.
+func defaultImageMirror() string {
+	if mirror := os.Getenv("NIXINIT_IMAGE_MIRROR"); mirror != "" {
+		return mirror
+	}
+	return defaultImageMirrorURL
+}
+
+// imageCacheDirectory returns the directory in which downloaded images are
+// kept: $NIXINIT_IMAGE_CACHE or nixinit/images in the user's cache directory.
+func imageCacheDirectory() (string, error) {
+	if directory := os.Getenv("NIXINIT_IMAGE_CACHE"); directory != "" {
+		return directory, nil
+	}
+	cacheDirectory, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %v", err)
+	}
+	return filepath.Join(cacheDirectory, "nixinit", "images"), nil
+}
+
+// imageCache is a local directory of verified bootstrap images downloaded
+// from a mirror.
+type imageCache struct {
+	directory string
+	mirrorURL string
+	// publicKey verifies the signature of the manifest if set.
+	publicKey ed25519.PublicKey
+	client    *http.Client
+	// offline uses cached images without fetching the manifest.
+	offline bool
+}
+
+// cachedImage is an image, or a partial download of one, in the cache.
+type cachedImage struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+	Partial  bool
+}
+
+// downloadProgressFunc is called as an image is downloaded with the bytes
+// written so far and the size of the image, or -1 if it is not known.
+type downloadProgressFunc func(current, total int64)
+
+// newImageCache returns the image cache configured with --image-mirror,
+// --image-public-key and --offline.
+func newImageCache() (*imageCache, error) {
+	directory, err := imageCacheDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &imageCache{
+		directory: directory,
+		mirrorURL: strings.TrimSuffix(imageMirrorURL, "/"),
+		// there is no overall timeout as images are large; requests are
+		// cancelled with their context instead
+		client:  &http.Client{},
+		offline: imageOffline,
+	}
+	if imagePublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(imagePublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid image public key - must be a base64 encoded ed25519 public key")
+		}
+		cache.publicKey = ed25519.PublicKey(key)
+	}
+	return cache, nil
+}
+
+// path returns the path of image name in the cache.
+func (c *imageCache) path(name string) string {
+	return filepath.Join(c.directory, name)
+}
+
+// parseImageManifest parses the output of sha256sum into a map from file
+// name to checksum.
+func parseImageManifest(data []byte) (map[string]string, error) {
+	manifest := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		checksum, name, found := strings.Cut(text, " ")
+		// sha256sum marks files read in binary mode with *
+		name = strings.TrimPrefix(strings.TrimSpace(name), "*")
+		if _, err := hex.DecodeString(checksum); !found || err != nil || len(checksum) != sha256.Size*2 || name == "" {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", line, text)
+		}
+		manifest[name] = strings.ToLower(checksum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// get fetches a small file, ie the manifest, from the mirror.
+func (c *imageCache) get(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.mirrorURL+"/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: HTTP status %d", name, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// fetchManifest downloads the manifest from the mirror, checking its
+// signature if a public key is configured.
+func (c *imageCache) fetchManifest(ctx context.Context) (map[string]string, error) {
+	data, err := c.get(ctx, imageManifestName)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.publicKey != nil {
+		signature, err := c.get(ctx, imageSignatureName)
+		if err != nil {
+			return nil, err
+		}
+		if len(signature) != ed25519.SignatureSize {
+			signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+			if err != nil {
+				return nil, fmt.Errorf("invalid manifest signature: %v", err)
+			}
+		}
+		if !ed25519.Verify(c.publicKey, data, signature) {
+			return nil, fmt.Errorf("manifest signature does not match the image public key")
+		}
+	}
+	return parseImageManifest(data)
+}
+
+// fileSHA256 returns the hex encoded sha256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// qcow2Magic is the first four bytes of a qcow2 image.
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// checkQcow2File returns an error if path is not a qcow2 image.
+func checkQcow2File(path string) error {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(qcow2Magic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, qcow2Magic) {
+		return fmt.Errorf("%s is not a qcow2 image", path)
+	}
+	return nil
+}
+
+// progressWriter reports the bytes written through it.
+type progressWriter struct {
+	w        io.Writer
+	current  int64
+	total    int64
+	progress downloadProgressFunc
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.current += int64(n)
+	if p.progress != nil {
+		p.progress(p.current, p.total)
+	}
+	return n, err
+}
+
+// download fetches image name into its partial file in the cache, resuming
+// a previous download if the mirror supports range requests.
+func (c *imageCache) download(ctx context.Context, name string, progress downloadProgressFunc) error {
+	partialPath := c.path(name) + partialImageSuffix
+	f, err := os.OpenFile(filepath.Clean(partialPath), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", partialPath, err)
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to seek to end of %s: %v", partialPath, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.mirrorURL+"/"+name, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		pterm.Debug.Printf("Resuming download of %s at %d bytes\n", name, offset)
+	case resp.StatusCode == http.StatusPartialContent:
+		// the range does not follow on from the partial file, which is
+		// discarded so that the next attempt starts again
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate %s: %v", partialPath, err)
+		}
+		return fmt.Errorf("failed to download %s: mirror returned range %q when resuming at %d bytes", name, resp.Header.Get("Content-Range"), offset)
+	case resp.StatusCode == http.StatusOK:
+		// the mirror ignored the range, so start again
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate %s: %v", partialPath, err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek to start of %s: %v", partialPath, err)
+		}
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial file is already complete; its checksum is verified by
+		// the caller
+		return nil
+	default:
+		return fmt.Errorf("failed to download %s: HTTP status %d", name, resp.StatusCode)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	writer := &progressWriter{w: f, current: offset, total: total, progress: progress}
+	if _, err := io.Copy(writer, resp.Body); err != nil {
+		return fmt.Errorf("failed to download %s: %v", name, err)
+	}
+	if total >= 0 && writer.current != total {
+		return fmt.Errorf("failed to download %s: got %d of %d bytes", name, writer.current, total)
+	}
+	return f.Close()
+}
+
+// pull returns the path of image name in the cache, downloading it from the
+// mirror if it is missing or force is set. The image is verified against the
+// manifest whether or not it was downloaded, unless the cache is offline or
+// the manifest cannot be fetched, in which case a cached image is used as it
+// was verified when it was downloaded.
+func (c *imageCache) pull(ctx context.Context, name string, force bool, progress downloadProgressFunc) (string, error) {
+	if !imageNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid image %q - must be the name of a .qcow2 image", name)
+	}
+	imagePath := c.path(name)
+	if c.offline {
+		if force {
+			return "", fmt.Errorf("cannot download %s again while offline", name)
+		}
+		if _, err := os.Stat(imagePath); err != nil {
+			return "", fmt.Errorf("image %s is not in the cache and cannot be downloaded while offline", name)
+		}
+		pterm.Debug.Printf("Using cached image %s\n", imagePath)
+		return imagePath, nil
+	}
+
+	manifest, err := c.fetchManifest(ctx)
+	if err != nil {
+		if _, statErr := os.Stat(imagePath); statErr != nil || force {
+			return "", err
+		}
+		pterm.Warning.Printf("Failed to fetch the image manifest (%v) - using cached image %s\n", err, imagePath)
+		return imagePath, nil
+	}
+	expected, ok := manifest[name]
+	if !ok {
+		return "", fmt.Errorf("image %s is not in the manifest at %s", name, c.mirrorURL)
+	}
+
+	if !force {
+		checksum, err := fileSHA256(imagePath)
+		switch {
+		case err == nil && checksum == expected:
+			pterm.Debug.Printf("Using cached image %s\n", imagePath)
+			return imagePath, nil
+		case err == nil:
+			pterm.Warning.Printf("Cached image %s does not match the manifest - downloading it again\n", imagePath)
+		case !errors.Is(err, os.ErrNotExist):
+			return "", fmt.Errorf("failed to read cached image %s: %v", imagePath, err)
+		}
+	}
+
+	if err := os.MkdirAll(c.directory, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create image cache %s: %v", c.directory, err)
+	}
+	partialPath := imagePath + partialImageSuffix
+	if force {
+		if err := os.Remove(partialPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to remove %s: %v", partialPath, err)
+		}
+	}
+	if err := c.download(ctx, name, progress); err != nil {
+		return "", err
+	}
+
+	checksum, err := fileSHA256(partialPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read downloaded image %s: %v", partialPath, err)
+	}
+	if checksum != expected {
+		// a resumed download may have been corrupted, so do not resume again
+		os.Remove(partialPath)
+		return "", fmt.Errorf("checksum of downloaded image %s is %s, expected %s", name, checksum, expected)
+	}
+	if err := os.Rename(partialPath, imagePath); err != nil {
+		return "", fmt.Errorf("failed to move downloaded image into the cache: %v", err)
+	}
+	return imagePath, nil
+}
+
+// list returns the images and partial downloads in the cache.
+func (c *imageCache) list() ([]cachedImage, error) {
+	entries, err := os.ReadDir(c.directory)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image cache %s: %v", c.directory, err)
+	}
+
+	var images []cachedImage
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image cache %s: %v", c.directory, err)
+		}
+		name, partial := strings.CutSuffix(entry.Name(), partialImageSuffix)
+		if !imageNamePattern.MatchString(name) {
+			continue
+		}
+		images = append(images, cachedImage{Name: name, Size: info.Size(), Modified: info.ModTime(), Partial: partial})
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name != images[j].Name {
+			return images[i].Name < images[j].Name
+		}
+		return !images[i].Partial
+	})
+	return images, nil
+}
+
+// remove deletes image name, and any partial download of it, from the cache.
+func (c *imageCache) remove(name string) error {
+	if !imageNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid image %q - must be the name of a .qcow2 image", name)
+	}
+
+	var removed bool
+	for _, path := range []string{c.path(name), c.path(name) + partialImageSuffix} {
+		err := os.Remove(path)
+		if err == nil {
+			removed = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+	}
+	if !removed {
+		return fmt.Errorf("image %s is not in the cache", name)
+	}
+	return nil
+}
+
+// newDownloadProgress returns a progress function which shows a pterm
+// progress bar, in MiB, for the download of image name, and a function which
+// removes the bar if the download stops early.
+func newDownloadProgress(name string) (downloadProgressFunc, func()) {
+	var bar *pterm.ProgressbarPrinter
+	progress := func(current, total int64) {
+		if total <= 0 {
+			return
+		}
+		if bar == nil {
+			bar, _ = pterm.DefaultProgressbar.
+				WithTitle(fmt.Sprintf("Downloading %s (MiB)", name)).
+				WithTotal(int((total + 1<<20 - 1) >> 20)).
+				WithCurrent(int(current >> 20)).
+				Start()
+		}
+		if current == total {
+			bar.Add(bar.Total - bar.Current)
+		} else if delta := int(current>>20) - bar.Current; delta > 0 {
+			bar.Add(delta)
+		}
+	}
+	stop := func() {
+		if bar != nil && bar.IsActive {
+			bar.Stop()
+		}
+	}
+	return progress, stop
+}
@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testImageName = "nixinit-bootstrap.qcow2"
+
+var testImage = bytes.Repeat([]byte("nixinit"), 1000)
+
+// newTestMirror serves testImage, with range support, and a manifest listing
+// checksum for it; the ranges requested are recorded in ranges.
+func newTestMirror(t *testing.T, checksum string, signature []byte, ranges *[]string) *httptest.Server {
+	manifest := fmt.Sprintf("%s  %s\n", checksum, testImageName)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+imageManifestName, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(manifest))
+	})
+	mux.HandleFunc("/"+imageSignatureName, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signature)
+	})
+	mux.HandleFunc("/"+testImageName, func(w http.ResponseWriter, r *http.Request) {
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, testImageName, time.Time{}, bytes.NewReader(testImage))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testImageChecksum() string {
+	sum := sha256.Sum256(testImage)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseImageManifest(t *testing.T) {
+	checksum := testImageChecksum()
+	manifest, err := parseImageManifest([]byte("# images\n" + strings.ToUpper(checksum) + " *a.qcow2\n\n" + checksum + "  b.qcow2\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if manifest["a.qcow2"] != checksum || manifest["b.qcow2"] != checksum || len(manifest) != 2 {
+		t.Errorf("unexpected manifest %v", manifest)
+	}
+
+	if _, err := parseImageManifest([]byte("deadbeef  a.qcow2\n")); err == nil {
+		t.Errorf("expected a short checksum to be rejected")
+	}
+}
+
+func TestImageCachePull(t *testing.T) {
+	var ranges []string
+	server := newTestMirror(t, testImageChecksum(), nil, &ranges)
+	cache := &imageCache{directory: t.TempDir(), mirrorURL: server.URL, client: server.Client()}
+
+	var progressed int64
+	imagePath, err := cache.pull(context.Background(), testImageName, false, func(current, total int64) {
+		if total != int64(len(testImage)) {
+			t.Errorf("expected total %d, got %d", len(testImage), total)
+		}
+		progressed = current
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if progressed != int64(len(testImage)) {
+		t.Errorf("expected progress to reach %d, got %d", len(testImage), progressed)
+	}
+	data, err := os.ReadFile(imagePath)
+	if err != nil || !bytes.Equal(data, testImage) {
+		t.Fatalf("expected the image to be cached at %s: %v", imagePath, err)
+	}
+
+	// a verified cached image is not downloaded again
+	if _, err := cache.pull(context.Background(), testImageName, false, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ranges) != 1 {
+		t.Errorf("expected 1 download, got %d", len(ranges))
+	}
+}
+
+func TestImageCachePullResumes(t *testing.T) {
+	var ranges []string
+	server := newTestMirror(t, testImageChecksum(), nil, &ranges)
+	cache := &imageCache{directory: t.TempDir(), mirrorURL: server.URL, client: server.Client()}
+
+	partialPath := cache.path(testImageName) + partialImageSuffix
+	if err := os.WriteFile(partialPath, testImage[:1234], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	imagePath, err := cache.pull(context.Background(), testImageName, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=1234-" {
+		t.Errorf("expected the download to resume at byte 1234, got ranges %q", ranges)
+	}
+	if data, _ := os.ReadFile(imagePath); !bytes.Equal(data, testImage) {
+		t.Errorf("resumed image does not match")
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Errorf("expected the partial download to be removed")
+	}
+}
+
+func TestImageCachePullRejectsChecksumMismatch(t *testing.T) {
+	var ranges []string
+	server := newTestMirror(t, strings.Repeat("0", 64), nil, &ranges)
+	cache := &imageCache{directory: t.TempDir(), mirrorURL: server.URL, client: server.Client()}
+
+	if _, err := cache.pull(context.Background(), testImageName, false, nil); err == nil {
+		t.Fatalf("expected a checksum mismatch")
+	}
+	images, err := cache.list()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(images) != 0 {
+		t.Errorf("expected nothing to be cached, got %v", images)
+	}
+}
+
+func TestImageCacheManifestSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum := testImageChecksum()
+	signature := ed25519.Sign(privateKey, []byte(fmt.Sprintf("%s  %s\n", checksum, testImageName)))
+
+	var ranges []string
+	server := newTestMirror(t, checksum, signature, &ranges)
+	cache := &imageCache{directory: t.TempDir(), mirrorURL: server.URL, client: server.Client(), publicKey: publicKey}
+	if _, err := cache.fetchManifest(context.Background()); err != nil {
+		t.Errorf("expected a valid signature to be accepted: %v", err)
+	}
+
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.publicKey = otherKey
+	if _, err := cache.fetchManifest(context.Background()); err == nil {
+		t.Errorf("expected a signature from another key to be rejected")
+	}
+}
+
+func TestImageCacheRemove(t *testing.T) {
+	cache := &imageCache{directory: t.TempDir()}
+	for _, name := range []string{testImageName, testImageName + partialImageSuffix} {
+		if err := os.WriteFile(filepath.Join(cache.directory, name), testImage, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	images, err := cache.list()
+	if err != nil || len(images) != 2 || images[0].Partial || !images[1].Partial {
+		t.Fatalf("expected a complete and a partial image, got %v: %v", images, err)
+	}
+	if err := cache.remove(testImageName); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if images, _ := cache.list(); len(images) != 0 {
+		t.Errorf("expected the cache to be empty, got %v", images)
+	}
+	if err := cache.remove(testImageName); err == nil {
+		t.Errorf("expected removing a missing image to fail")
+	}
+	if err := cache.remove("../escape.qcow2"); err == nil {
+		t.Errorf("expected an invalid name to be rejected")
+	}
+}
+
+func TestCheckQcow2File(t *testing.T) {
+	directory := t.TempDir()
+	qcow2Path := filepath.Join(directory, "image.qcow2")
+	rawPath := filepath.Join(directory, "image.raw")
+	if err := os.WriteFile(qcow2Path, append(append([]byte{}, qcow2Magic...), 0, 0, 0, 3), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rawPath, []byte("QF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkQcow2File(qcow2Path); err != nil {
+		t.Errorf("expected %s to be accepted: %v", qcow2Path, err)
+	}
+	if err := checkQcow2File(rawPath); err == nil {
+		t.Errorf("expected %s to be rejected", rawPath)
+	}
+	if err := checkQcow2File(filepath.Join(directory, "missing.qcow2")); err == nil {
+		t.Errorf("expected a missing file to be rejected")
+	}
+}
+
+func TestImageCachePullUsesCacheWithoutManifest(t *testing.T) {
+	var ranges []string
+	server := newTestMirror(t, testImageChecksum(), nil, &ranges)
+	cache := &imageCache{directory: t.TempDir(), mirrorURL: server.URL, client: server.Client()}
+	imagePath, err := cache.pull(context.Background(), testImageName, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the mirror is down
+	server.Close()
+	if cached, err := cache.pull(context.Background(), testImageName, false, nil); err != nil || cached != imagePath {
+		t.Errorf("expected the cached image to be used, got %q: %v", cached, err)
+	}
+	if _, err := cache.pull(context.Background(), testImageName, true, nil); err == nil {
+		t.Errorf("expected a forced pull to fail without the manifest")
+	}
+
+	cache.offline = true
+	if cached, err := cache.pull(context.Background(), testImageName, false, nil); err != nil || cached != imagePath {
+		t.Errorf("expected the cached image to be used offline, got %q: %v", cached, err)
+	}
+	if _, err := cache.pull(context.Background(), "missing.qcow2", false, nil); err == nil {
+		t.Errorf("expected an image which is not cached to fail offline")
+	}
+}
+
+func TestImageCachePullDiscardsMismatchedRange(t *testing.T) {
+	// the mirror answers a range request with the wrong range
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+imageManifestName {
+			fmt.Fprintf(w, "%s  %s\n", testImageChecksum(), testImageName)
+			return
+		}
+		requests++
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(testImage)-1, len(testImage)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(testImage)
+			return
+		}
+		w.Write(testImage)
+	}))
+	t.Cleanup(server.Close)
+	cache := &imageCache{directory: t.TempDir(), mirrorURL: server.URL, client: server.Client()}
+
+	partialPath := cache.path(testImageName) + partialImageSuffix
+	if err := os.WriteFile(partialPath, testImage[:1234], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.pull(context.Background(), testImageName, false, nil); err == nil {
+		t.Fatalf("expected a mismatched range to be rejected")
+	}
+	// the retry starts again rather than failing in the same way
+	imagePath, err := cache.pull(context.Background(), testImageName, false, nil)
+	if err != nil {
+		t.Fatalf("expected the retry to succeed: %v", err)
+	}
+	if data, _ := os.ReadFile(imagePath); !bytes.Equal(data, testImage) {
+		t.Errorf("downloaded image does not match")
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 downloads, got %d", requests)
+	}
+}
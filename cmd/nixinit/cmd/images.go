@@ -0,0 +1,144 @@
+// Package cmd provides the command-line interface for the nixinit-server application.
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// imagesCmd represents the images command
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "manages the local cache of bootstrap images",
+	Long: `images lists, downloads and removes the bootstrap images kept in the local
+image cache, which is $NIXINIT_IMAGE_CACHE or nixinit/images in the user's cache
+directory.
+
+Images are downloaded from --image-mirror and verified against the sha256
+checksums in its SHA256SUMS manifest. If --image-public-key is given, the
+manifest must be signed with the matching ed25519 key in SHA256SUMS.sig.
+Interrupted downloads are resumed. Images are only added to the cache once
+verified, so with --offline, or if the manifest cannot be downloaded, cached
+images are used as they are.`,
+}
+
+// imagesListCmd represents the images list command
+var imagesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists the images in the local cache",
+	Args:  cobra.NoArgs,
+	Run:   listImages,
+}
+
+// imagesPullCmd represents the images pull command
+var imagesPullCmd = &cobra.Command{
+	Use:   "pull [image]...",
+	Short: "downloads images into the local cache",
+	Long: `pull downloads and verifies the given images, or the bootstrap image for
+the default architecture if none are given. Cached images which match the
+manifest are not downloaded again unless --force is given.`,
+	Run: pullImages,
+}
+
+// imagesRmCmd represents the images rm command
+var imagesRmCmd = &cobra.Command{
+	Use:   "rm image...",
+	Short: "removes images from the local cache",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   removeImages,
+}
+
+var imagesPullForce bool
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+	imagesCmd.AddCommand(imagesListCmd)
+	imagesCmd.AddCommand(imagesPullCmd)
+	imagesCmd.AddCommand(imagesRmCmd)
+
+	imagesPullCmd.Flags().BoolVar(&imagesPullForce, "force", false, "Download images even if they are already cached")
+}
+
+func listImages(cmd *cobra.Command, args []string) {
+	cache, err := newImageCache()
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
+		return
+	}
+	images, err := cache.list()
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
+		return
+	}
+	if len(images) == 0 {
+		pterm.Info.Printf("No images in %s\n", cache.directory)
+		return
+	}
+
+	tableData := pterm.TableData{{"NAME", "SIZE", "MODIFIED", "STATUS"}}
+	for _, image := range images {
+		status := "complete"
+		if image.Partial {
+			status = "partial"
+		}
+		tableData = append(tableData, []string{
+			image.Name,
+			fmt.Sprintf("%.1f MiB", float64(image.Size)/(1<<20)),
+			image.Modified.Local().Format(time.DateTime),
+			status,
+		})
+	}
+	if err := pterm.DefaultTable.WithHasHeader().WithData(tableData).Render(); err != nil {
+		pterm.Error.Printf("Failed to render table: %v\n", err)
+	}
+}
+
+func pullImages(cmd *cobra.Command, args []string) {
+	names := args
+	if len(names) == 0 {
+		names = []string{defaultBootstrapProfile.guestArchitecture().ImageName}
+	}
+
+	cache, err := newImageCache()
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
+		return
+	}
+
+	// on Ctrl-C the download stops and is resumed by the next pull
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, name := range names {
+		progress, stopProgress := newDownloadProgress(name)
+		imagePath, err := cache.pull(ctx, name, imagesPullForce, progress)
+		stopProgress()
+		if err != nil {
+			pterm.Error.Printf("Failed to pull %s: %v\n", name, err)
+			continue
+		}
+		pterm.Success.Printf("Image %s is in the cache at %s\n", name, imagePath)
+	}
+}
+
+func removeImages(cmd *cobra.Command, args []string) {
+	cache, err := newImageCache()
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
+		return
+	}
+	for _, name := range args {
+		if err := cache.remove(name); err != nil {
+			pterm.Error.Printf("%v\n", err)
+			continue
+		}
+		pterm.Success.Printf("Removed %s from the cache\n", name)
+	}
+}
@@ -2,15 +2,14 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/xml"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -44,12 +43,105 @@ type DomainXML struct {
 var (
 	nixinitIsoPoolName    = "nixinit-iso"
 	nixinitVolumePoolName = "nixinit-volume"
-	isoImageName          = "cidata"
+	// isoImageName is the volume label of the seed ISO, which the server
+	// looks for, and the prefix of the names of the seed ISO volumes.
+	isoImageName = "cidata"
 )
 
+// domainUndefineFlags are used whenever a bootstrap domain is undefined; the
+// NVRAM file of an EFI guest, such as an aarch64 bootstrap, belongs to the
+// domain and would otherwise be left behind.
+const domainUndefineFlags = libvirt.DomainUndefineNvram
+
 // UserData is the user-data section of the cloud-init configuration.
 type UserData struct {
-	Description string `yaml:"description,omitempty"`
+	Description   string   `yaml:"description,omitempty"`
+	WebhookURL    string   `yaml:"webhook_url,omitempty"`
+	WebhookSecret string   `yaml:"webhook_secret,omitempty"`
+	AllowedCIDRs  []string `yaml:"allowed_cidrs,omitempty"`
+}
+
+// guestArchitecture describes how to launch a guest of a given architecture.
+type guestArchitecture struct {
+	// Arch is the libvirt architecture of the guest.
+	Arch string
+	// Machine is the machine type of the guest.
+	Machine string
+	// EFI is true if the guest must boot with UEFI firmware; libvirt selects
+	// the firmware for the architecture, ie AAVMF on aarch64.
+	EFI bool
+	// CdromBus is the bus to which the cidata ISO is attached.
+	CdromBus string
+	// ImageName is the name of the bootstrap image for the architecture.
+	ImageName string
+}
+
+var guestArchitectures = map[string]guestArchitecture{
+	"x86_64": {
+		Arch:      "x86_64",
+		Machine:   "pc-q35-8.2",
+		CdromBus:  "sata",
+		ImageName: "nixinit-bootstrap.qcow2",
+	},
+	"aarch64": {
+		Arch:      "aarch64",
+		Machine:   "virt",
+		EFI:       true,
+		CdromBus:  "scsi",
+		ImageName: "nixinit-bootstrap-aarch64.qcow2",
+	},
+}
+
+// hostArchitecture returns the libvirt architecture of the machine the client
+// runs on.
+func hostArchitecture() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	default:
+		return runtime.GOARCH
+	}
+}
+
+// domainType returns kvm if the guest can be accelerated on this host, and
+// qemu (emulation) otherwise.
+func (a guestArchitecture) domainType() string {
+	if a.Arch == hostArchitecture() {
+		return "kvm"
+	}
+	return "qemu"
+}
+
+// osXML returns the os element of the domain XML.
+func (a guestArchitecture) osXML() string {
+	firmware := ""
+	if a.EFI {
+		firmware = " firmware='efi'"
+	}
+	return fmt.Sprintf(`<os%s>
+        <type arch='%s' machine='%s'>hvm</type>
+        <boot dev='hd'/>
+      </os>`, firmware, a.Arch, a.Machine)
+}
+
+// devicesXML returns the devices needed by the architecture in addition to the
+// disks, network interface and console.
+func (a guestArchitecture) devicesXML() string {
+	if a.CdromBus == "scsi" {
+		return "<controller type='scsi' model='virtio-scsi'/>"
+	}
+	return ""
+}
+
+// cpuXML returns the cpu element of the domain XML; the host cpu is passed
+// through when the guest is accelerated.
+func (a guestArchitecture) cpuXML() string {
+	if a.Arch != "x86_64" && a.domainType() == "kvm" {
+		return "<cpu mode='host-passthrough'/>"
+	}
+	return ""
 }
 
 // MetaData is the meta-data section of the cloud-init configuration.
@@ -57,15 +149,49 @@ type MetaData struct {
 	InstanceID string `yaml:"instance_id,omitempty"`
 }
 
-func uploadBootstrapImage() {
-	cloudflarePublicBucketURL := "https://pub-5e2d0f66ccb2405aa99e1cea5de9f473.r2.dev"
-	imageName := "nixinit-bootstrap.qcow2"
-	imageURL := cloudflarePublicBucketURL + "/" + imageName
+// acquireBootstrapImage returns the base image imageName in the
+// nixinit-volume pool. If it is missing, it is uploaded from --image-file or
+// else from the image cache, which downloads it from the mirror if needed.
+func acquireBootstrapImage(ctx context.Context, l *libvirt.Libvirt, imageName string) (libvirt.StorageVol, error) {
+	poolName := nixinitVolumePoolName
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("storage pool lookup failed: %w", err)
+	}
+
+	vol, err := l.StorageVolLookupByName(pool, imageName)
+	if err == nil {
+		log.Printf("Found QCOW image %s in pool %s", imageName, poolName)
+		if imageFile != "" {
+			log.Printf("Ignoring --image-file as %s is already in pool %s", imageName, poolName)
+		}
+		return vol, nil
+	}
+	if libvirtErr, ok := err.(libvirt.Error); !ok || libvirtErr.Code != uint32(libvirt.ErrNoStorageVol) {
+		return libvirt.StorageVol{}, fmt.Errorf("storage volume lookup failed: %w", err)
+	}
+
+	imagePath := imageFile
+	if imagePath == "" {
+		log.Printf("QCOW image %s does not exist in pool %s - fetching it from the image cache...", imageName, poolName)
+		cache, err := newImageCache()
+		if err != nil {
+			return libvirt.StorageVol{}, err
+		}
+		progress, stopProgress := newDownloadProgress(imageName)
+		imagePath, err = cache.pull(ctx, imageName, false, progress)
+		stopProgress()
+		if err != nil {
+			return libvirt.StorageVol{}, fmt.Errorf("failed to download bootstrap image: %w", err)
+		}
+	}
 
-	err := downloadAndUploadImage(imageURL, imageName)
+	log.Printf("Uploading %s to pool %s as %s...", imagePath, poolName, imageName)
+	vol, err = uploadVolumeToStoragePool(l, imagePath, poolName, imageName)
 	if err != nil {
-		log.Fatalf("Failed to download and upload bootstrap image: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to upload bootstrap image: %w", err)
 	}
+	return vol, nil
 }
 
 func getVMIPAddress(l *libvirt.Libvirt, dom libvirt.Domain) (string, error) {
@@ -90,37 +216,29 @@ func getVMIPAddress(l *libvirt.Libvirt, dom libvirt.Domain) (string, error) {
 	return "", fmt.Errorf("no suitable IP address found for the domain")
 }
 
-func uploadVolumeToStoragePool(filename, storagePool, imageName string) error {
+func uploadVolumeToStoragePool(l *libvirt.Libvirt, filename, storagePool, imageName string) (libvirt.StorageVol, error) {
 	// get size of file in bytes
 	fileInfo, err := os.Stat(filename)
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to get file info: %v", err)
 	}
 	fileSize := fileInfo.Size()
 
-	// Connect to libvirt
-	uri, _ := url.Parse(string(libvirt.QEMUSystem))
-	l, err := libvirt.ConnectToURI(uri)
-	if err != nil {
-		return fmt.Errorf("failed to connect to libvirt: %v", err)
-	}
-	defer l.Disconnect()
-
 	// Look up the default storage pool
 	pool, err := l.StoragePoolLookupByName(storagePool)
 	if err != nil {
-		return fmt.Errorf("failed to lookup storage pool: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to lookup storage pool: %v", err)
 	}
 
 	// Get the path of the storage pool
 	_, _, _, _, err = l.StoragePoolGetInfo(pool)
 	if err != nil {
-		return fmt.Errorf("failed to get storage pool info: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to get storage pool info: %v", err)
 	}
 
 	poolPath, err := l.StoragePoolGetXMLDesc(pool, 0)
 	if err != nil {
-		return fmt.Errorf("failed to get storage pool XML description: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to get storage pool XML description: %v", err)
 	}
 
 	// Extract the path from the XML
@@ -129,7 +247,7 @@ func uploadVolumeToStoragePool(filename, storagePool, imageName string) error {
 	}
 	unmarshalErr := xml.Unmarshal([]byte(poolPath), &poolXML)
 	if unmarshalErr != nil {
-		return fmt.Errorf("failed to parse storage pool XML: %v", unmarshalErr)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to parse storage pool XML: %v", unmarshalErr)
 	}
 	// if err := xml.Unmarshal([]byte(poolPath), &poolXML); err != nil {
 	// 	return fmt.Errorf("failed to parse storage pool XML: %v", err)
@@ -152,90 +270,39 @@ func uploadVolumeToStoragePool(filename, storagePool, imageName string) error {
 
 	vol, err := l.StorageVolCreateXML(pool, volumeXML, 0)
 	if err != nil {
-		return fmt.Errorf("failed to create storage volume: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to create storage volume: %v", err)
 	}
 
 	// Open the temporary file for reading
 	filenameCleaned := filepath.Clean(filename)
 	tempFile, err := os.OpenFile(filenameCleaned, os.O_RDONLY, 0600)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to open file: %v", err)
 	}
+	defer tempFile.Close()
 	_, err = tempFile.Seek(0, 0)
 	if err != nil {
-		return fmt.Errorf("failed to seek to start of temporary file: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to seek to start of temporary file: %v", err)
 	}
 	fileInfo, err = tempFile.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		return libvirt.StorageVol{}, fmt.Errorf("failed to get file info: %v", err)
 	}
 
 	// Upload the image content to the new volume
 	err = l.StorageVolUpload(vol, tempFile, 0, uint64(fileSize), 0)
 	if err != nil {
-		return fmt.Errorf("failed to upload image content: %v", err)
-	}
-
-	return nil
-}
-
-func downloadAndUploadImage(imageURL, imageName string) error {
-	// // Download the image from Cloudflare
-	// resp, err := http.Get(imageURL) // nolint
-	// if err != nil {
-	// 	return fmt.Errorf("failed to download image: %v", err)
-	// }
-	// defer resp.Body.Close()
-
-	req, err := http.NewRequest(http.MethodGet, imageURL, nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download image: HTTP status %d", resp.StatusCode)
-	}
-	log.Printf("Downloaded %s", imageName)
-
-	// Create a temporary file to store the downloaded image
-	tempFile, err := os.CreateTemp("", imageName)
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %v", err)
-	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
-
-	// Copy the downloaded content to the temporary file
-	_, err = io.Copy(tempFile, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write image to temporary file: %v", err)
-	}
-	log.Printf("Wrote %s to temporary file", imageName)
-
-	// upload volume to libvirt
-	err = uploadVolumeToStoragePool(tempFile.Name(), nixinitVolumePoolName, imageName)
-	if err != nil {
-		return fmt.Errorf("failed to upload volume to storage pool: %v", err)
+		// do not leave an incomplete volume behind
+		if deleteErr := l.StorageVolDelete(vol, 0); deleteErr != nil {
+			log.Printf("failed to delete incomplete volume %s: %v", imageName, deleteErr)
+		}
+		return libvirt.StorageVol{}, fmt.Errorf("failed to upload image content: %v", err)
 	}
 
-	log.Printf("Successfully downloaded and uploaded image %s to storage pool %s", imageName, nixinitVolumePoolName)
-	return nil
+	return vol, nil
 }
 
-func getIsoFilename(nixinitIsoPoolName, isoImageName string) (string, error) {
-	// Connect to libvirt
-	uri, _ := url.Parse(string(libvirt.QEMUSystem))
-	l, err := libvirt.ConnectToURI(uri)
-	if err != nil {
-		return "", fmt.Errorf("failed to connect to libvirt: %v", err)
-	}
-	defer l.Disconnect()
-
+func getIsoFilename(l *libvirt.Libvirt, nixinitIsoPoolName, isoImageName string) (string, error) {
 	// Look up the storage pool
 	pool, err := l.StoragePoolLookupByName(nixinitIsoPoolName)
 	if err != nil {
@@ -257,49 +324,66 @@ func getIsoFilename(nixinitIsoPoolName, isoImageName string) (string, error) {
 	return path, nil
 }
 
-func launchLibvirtInstance(qcowImageName, vmName string, memory uint64, vcpus uint) error {
+// launchLibvirtInstance launches a bootstrap described by profile. The launch
+// is transactional: if it fails, or ctx is cancelled, every resource created
+// so far is removed again unless keepOnFailure is set.
+func launchLibvirtInstance(ctx context.Context, l *libvirt.Libvirt, profile BootstrapProfile, userData UserData) (err error) {
+	arch := profile.guestArchitecture()
+	qcowImageName := arch.ImageName
+
 	// create random instanceID
 	instanceID := uuid.New().String()
 	log.Printf("Generated instance ID: %v", instanceID)
 
-	userData := UserData{Description: fmt.Sprintf("Created by nixinit for instance ID: %s", instanceID)}
-	metaData := MetaData{InstanceID: instanceID}
-	err := createISO(nixinitIsoPoolName, isoImageName, userData, metaData)
-	if err != nil {
-		return fmt.Errorf("failed to marshal user data and metadata: %v", err)
+	// the domain and its volumes are named after the instance so that several
+	// bootstraps can run side by side
+	vmName := profile.Name
+	if vmName == "" {
+		vmName = defaultDomainName(instanceID)
 	}
+	isoName := isoVolumeName(instanceID)
 
-	uri, _ := url.Parse(string(libvirt.QEMUSystem))
-	l, err := libvirt.ConnectToURI(uri)
-	if err != nil {
-		log.Fatalf("failed to connect: %v", err)
-		return err
-	}
-	defer l.Disconnect()
+	var created rollback
+	defer func() {
+		if err == nil {
+			return
+		}
+		if keepOnFailure {
+			for _, description := range created.describe() {
+				log.Printf("Keeping %s for debugging", description)
+			}
+			return
+		}
+		if !created.run() {
+			log.Printf("Some resources could not be removed - see remove-bootstraps --prune")
+		}
+	}()
 
-	log.Printf("Connected to libvirt at %s", uri)
+	if _, err := l.DomainLookupByName(vmName); err == nil {
+		return fmt.Errorf("a domain named %s already exists - choose another name with --name", vmName)
+	}
 
-	// Check if the storage pool exists
-	poolName := nixinitVolumePoolName
-	pool, err := l.StoragePoolLookupByName(poolName)
+	// the base image is shared by all bootstraps, so it is not rolled back
+	vol, err := acquireBootstrapImage(ctx, l, qcowImageName)
 	if err != nil {
-		log.Printf("storage pool lookup failed: %v", err)
-		return fmt.Errorf("storage pool lookup failed: %w", err)
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// check if the image exists
-	vol, err := l.StorageVolLookupByName(pool, qcowImageName)
+	userData.Description = fmt.Sprintf("Created by nixinit for instance ID: %s", instanceID)
+	metaData := MetaData{InstanceID: instanceID}
+	err = createISO(l, nixinitIsoPoolName, isoName, userData, metaData)
 	if err != nil {
-		if libvirtErr, ok := err.(libvirt.Error); ok && libvirtErr.Code == uint32(libvirt.ErrNoStorageVol) {
-			log.Printf("QCOW image  %s does not exist in pool %s - attempting to download from internet...", qcowImageName, poolName)
-			uploadBootstrapImage()
-
-		} else {
-			log.Printf("storage volume lookup failed: %v", err)
-			return fmt.Errorf("storage volume lookup failed: %w", err)
-		}
+		return fmt.Errorf("failed to marshal user data and metadata: %v", err)
+	}
+	created.add(fmt.Sprintf("seed ISO %s", isoName), func() error {
+		return removeISO(l, nixinitIsoPoolName, isoName)
+	})
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	log.Printf("Found QCOW image %s in pool %s", qcowImageName, poolName)
 
 	// Get the path of the QCOW image
 	qcowPath, err := l.StorageVolGetPath(vol)
@@ -308,8 +392,14 @@ func launchLibvirtInstance(qcowImageName, vmName string, memory uint64, vcpus ui
 		return fmt.Errorf("failed to get QCOW image path: %w", err)
 	}
 
+	// the disk of the bootstrap is created next to its base image
+	pool, err := l.StoragePoolLookupByName(vol.Pool)
+	if err != nil {
+		return fmt.Errorf("storage pool lookup failed: %w", err)
+	}
+
 	// Create a new volume based on the QCOW image
-	fileSize := 10 * 1024 * 1024 * 1024 // 10 GB
+	fileSize := profile.DiskSize * 1024 * 1024 * 1024
 	newVolName := fmt.Sprintf("%s-%s", vmName, qcowImageName)
 	newVolXML := fmt.Sprintf(`
     <volume>
@@ -330,6 +420,12 @@ func launchLibvirtInstance(qcowImageName, vmName string, memory uint64, vcpus ui
 		log.Printf("failed to create new volume: %v", err)
 		return fmt.Errorf("failed to create new volume: %w", err)
 	}
+	created.add(fmt.Sprintf("volume %s", newVolName), func() error {
+		return l.StorageVolDelete(newVol, 0)
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Get the path of the new volume
 	newVolPath, err := l.StorageVolGetPath(newVol)
@@ -338,22 +434,30 @@ func launchLibvirtInstance(qcowImageName, vmName string, memory uint64, vcpus ui
 		return fmt.Errorf("failed to get new volume path: %w", err)
 	}
 
-	isoFilename, err := getIsoFilename(nixinitIsoPoolName, isoImageName)
+	isoFilename, err := getIsoFilename(l, nixinitIsoPoolName, isoName)
 	if err != nil {
 		return fmt.Errorf("failed to get ISO filename: %v", err)
 	}
 
+	metadata := nixinitMetadata{
+		InstanceID:    instanceID,
+		Created:       time.Now(),
+		Image:         qcowImageName,
+		SeedISO:       seedISOInfo{Pool: nixinitIsoPoolName, Volume: isoName},
+		ClientVersion: version,
+	}
+
 	// Define the VM XML (use newVolPath instead of isoPath)
 	xmlConfig := fmt.Sprintf(`
-    <domain type='kvm'>
+    <domain type='%s'>
       <name>%s</name>
+      %s
       <memory unit='MiB'>%d</memory>
       <vcpu>%d</vcpu>
-		  <os>
-				<type arch='x86_64' machine='pc-q35-8.2'>hvm</type>
-				<boot dev='hd'/>
-			</os>
+      %s
+      %s
       <devices>
+        %s
         <disk type='file' device='disk'>
           <driver name='qemu' type='qcow2'/>
           <source file='%s'/>
@@ -362,22 +466,28 @@ func launchLibvirtInstance(qcowImageName, vmName string, memory uint64, vcpus ui
 		    <disk type='file' device='cdrom'>
 					<driver name='qemu' type='raw'/>
 					<source file='%s'/>
-					<target dev='vdb' bus='sata'/>
+					<target dev='sda' bus='%s'/>
 					<readonly/>
 				</disk>
         <interface type='network'>
-          <source network='default'/>
+          <source network='%s'/>
           <model type='virtio'/>
         </interface>
         <console type='pty'/>
       </devices>
-    </domain>`, vmName, memory, vcpus, newVolPath, isoFilename)
+    </domain>`, arch.domainType(), vmName, metadata.metadataXML(), profile.Memory, profile.VCPUs, arch.osXML(), arch.cpuXML(), arch.devicesXML(),
+		newVolPath, isoFilename, arch.CdromBus, profile.Network)
 
 	// Define the domain
 	dom, err := l.DomainDefineXML(xmlConfig)
 	if err != nil {
 		log.Printf("failed to define domain - error: %v", err)
-		log.Printf("it's possible that a domain with this name already exists, in which case you will need to remove the existing domain to bootstrap a new one...\n")
+		return err
+	}
+	created.add(fmt.Sprintf("domain %s", vmName), func() error {
+		return l.DomainUndefineFlags(dom, domainUndefineFlags)
+	})
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
@@ -387,6 +497,9 @@ func launchLibvirtInstance(qcowImageName, vmName string, memory uint64, vcpus ui
 		log.Printf("failed to start domain: %v", err)
 		return fmt.Errorf("failed to start domain: %w", err)
 	}
+	created.add(fmt.Sprintf("running domain %s", vmName), func() error {
+		return l.DomainDestroy(dom)
+	})
 
 	// Get the status of the VM
 	// TODO: - check that the VM is running before trying to get its IP address
@@ -410,7 +523,11 @@ func launchLibvirtInstance(qcowImageName, vmName string, memory uint64, vcpus ui
 		log.Printf("Attempt %d to get VM IP address...", i+1)
 
 		// Wait for 10 seconds before attempting to get the IP
-		time.Sleep(10 * time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
 
 		ip, err = getVMIPAddress(l, dom)
 		if err == nil {
@@ -454,16 +571,7 @@ func getDomainStateString(state int32) string {
 }
 
 // removeISO removes the ISO file from the system
-func removeISO(storagePool, isoFilename string) (err error) {
-
-	// Connect to libvirt
-	uri, _ := url.Parse(string(libvirt.QEMUSystem))
-	l, err := libvirt.ConnectToURI(uri)
-	if err != nil {
-		return fmt.Errorf("failed to connect to libvirt: %v", err)
-	}
-	defer l.Disconnect()
-
+func removeISO(l *libvirt.Libvirt, storagePool, isoFilename string) (err error) {
 	// Look up the default storage pool
 	pool, err := l.StoragePoolLookupByName(storagePool)
 	if err != nil {
@@ -492,7 +600,9 @@ func removeISO(storagePool, isoFilename string) (err error) {
 	return nil
 }
 
-func createISO(isoPoolName, filename string, userData UserData, metaData MetaData) error {
+// createISO creates the seed ISO for an instance and uploads it to isoPoolName
+// as volumeName.
+func createISO(l *libvirt.Libvirt, isoPoolName, volumeName string, userData UserData, metaData MetaData) error {
 	writer, err := iso9660.NewWriter()
 	if err != nil {
 		log.Fatalf("failed to create writer: %s", err)
@@ -514,12 +624,12 @@ func createISO(isoPoolName, filename string, userData UserData, metaData MetaDat
 		return fmt.Errorf("failed to add file: %w", err)
 	}
 
-	cleanedFilename := filepath.Clean(filename)
-	outputFile, err := os.OpenFile(cleanedFilename, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	outputFile, err := os.CreateTemp("", volumeName)
 	if err != nil {
 		log.Printf("failed to create file: %s", err)
 		return fmt.Errorf("failed to create file: %w", err)
 	}
+	defer os.Remove(outputFile.Name())
 
 	err = writer.WriteTo(outputFile, "cidata")
 	if err != nil {
@@ -533,7 +643,7 @@ func createISO(isoPoolName, filename string, userData UserData, metaData MetaDat
 		return fmt.Errorf("failed to close output file: %w", err)
 	}
 
-	err = uploadVolumeToStoragePool(filename, isoPoolName, "cidata")
+	_, err = uploadVolumeToStoragePool(l, outputFile.Name(), isoPoolName, volumeName)
 	if err != nil {
 		return fmt.Errorf("failed to upload ISO to storage pool: %w", err)
 	}
@@ -541,16 +651,23 @@ func createISO(isoPoolName, filename string, userData UserData, metaData MetaDat
 	return nil
 }
 
-func getBootstrapVMs() ([]string, error) {
-
-	var bootstrapVMs []string
-	uri, _ := url.Parse(string(libvirt.QEMUSystem))
-	l, err := libvirt.ConnectToURI(uri)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to libvirt: %v", err)
-	}
-	defer l.Disconnect()
+// bootstrapVM is a domain created by nixinit.
+type bootstrapVM struct {
+	Name     string
+	UUID     string
+	Metadata nixinitMetadata
+	State    string
+	// Memory is the memory of the domain in MiB.
+	Memory uint64
+	VCPUs  uint16
+	// IP is the address of a running domain, if it has been leased one.
+	IP string
+}
 
+// getBootstrapVMs returns the domains created by nixinit, identified by their
+// nixinit metadata.
+func getBootstrapVMs(l *libvirt.Libvirt) ([]bootstrapVM, error) {
+	var bootstrapVMs []bootstrapVM
 	domains, _, err := l.ConnectListAllDomains(1, 0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list domains: %v", err)
@@ -558,9 +675,31 @@ func getBootstrapVMs() ([]string, error) {
 
 	for _, dom := range domains {
 		// log.Printf("Domain ID: %v, Name: %v\n", dom.ID, dom.Name)
-		if dom.Name == "nixinit" {
-			bootstrapVMs = append(bootstrapVMs, fmt.Sprintf("%x", dom.UUID))
+		metadata, err := getNixinitMetadata(l, dom)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			continue
+		}
+
+		state, maxMemory, _, vcpus, _, err := l.DomainGetInfo(dom)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get info of domain %s: %v", dom.Name, err)
+		}
+		vm := bootstrapVM{
+			Name:     dom.Name,
+			UUID:     uuid.UUID(dom.UUID).String(),
+			Metadata: *metadata,
+			State:    getDomainStateString(int32(state)),
+			Memory:   maxMemory / 1024,
+			VCPUs:    vcpus,
 		}
+		if libvirt.DomainState(state) == libvirt.DomainRunning {
+			// a domain which is still booting has no address yet
+			vm.IP, _ = getVMIPAddress(l, dom)
+		}
+		bootstrapVMs = append(bootstrapVMs, vm)
 	}
 
 	return bootstrapVMs, nil
@@ -634,17 +773,7 @@ func removeVolume(l *libvirt.Libvirt, volumePath string) error {
 	return nil
 }
 
-func removeInstance(instanceUUID string) error {
-	// Parse the libvirt URI
-	uri, _ := url.Parse(string(libvirt.QEMUSystem))
-
-	// Connect to libvirt
-	l, err := libvirt.ConnectToURI(uri)
-	if err != nil {
-		return fmt.Errorf("failed to connect to libvirt: %v", err)
-	}
-	defer l.Disconnect()
-
+func removeInstance(l *libvirt.Libvirt, instanceUUID string) error {
 	// Convert string UUID to byte array
 	uuidBytes, err := ParseUUID(instanceUUID)
 	if err != nil {
@@ -661,6 +790,15 @@ func removeInstance(instanceUUID string) error {
 		return fmt.Errorf("failed to find domain with UUID %s: %v", instanceUUID, err)
 	}
 
+	// only domains created by nixinit are removed
+	metadata, err := getNixinitMetadata(l, dom)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		return fmt.Errorf("domain %s was not created by nixinit", dom.Name)
+	}
+
 	// Get volumes attached to the domain
 	volumes, err := getVolumesAttachedToDomain(l, dom)
 	if err != nil {
@@ -684,7 +822,7 @@ func removeInstance(instanceUUID string) error {
 	}
 
 	// Undefine the domain
-	err = l.DomainUndefineFlags(dom, libvirt.DomainUndefineKeepNvram)
+	err = l.DomainUndefineFlags(dom, domainUndefineFlags)
 	if err != nil {
 		return fmt.Errorf("failed to undefine domain %s: %v", dom.Name, err)
 	}
@@ -699,8 +837,8 @@ func removeInstance(instanceUUID string) error {
 		}
 	}
 
-	// remove the ISO file
-	err = removeISO(nixinitIsoPoolName, isoImageName)
+	// remove the instance's seed ISO
+	err = removeISO(l, metadata.SeedISO.Pool, metadata.SeedISO.Volume)
 	if err != nil {
 		log.Printf("Error removing ISO file: %v", err)
 		// Decide whether to continue or exit based on your requirements
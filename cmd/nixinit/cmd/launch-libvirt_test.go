@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+func TestDomainUndefineRemovesNvram(t *testing.T) {
+	if domainUndefineFlags&libvirt.DomainUndefineNvram == 0 {
+		t.Errorf("expected undefining a domain to remove its NVRAM")
+	}
+	if domainUndefineFlags&libvirt.DomainUndefineKeepNvram != 0 {
+		t.Errorf("expected undefining a domain not to keep its NVRAM")
+	}
+}
@@ -2,24 +2,31 @@
 package cmd
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
 // listBootstrapsCmd represents the listBootstraps command
 var listBootstrapsCmd = &cobra.Command{
 	Use:   "list-bootstraps",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "lists the bootstrap instances created by nixinit",
+	Long: `list-bootstraps lists the libvirt domains created by nixinit with their
+nixinit instance ID, state, address, size and, for running instances, the state
+reported by their nixinit-server.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+Use --output json or --output yaml for output suitable for scripts.`,
 	Run: listBootstraps,
 }
 
+var listOutput string
+
 func init() {
 	rootCmd.AddCommand(listBootstrapsCmd)
 
@@ -31,17 +38,132 @@ func init() {
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
-	// listBootstrapsCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	listBootstrapsCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "Output format (table, json or yaml)")
+	listBootstrapsCmd.Flags().IntVarP(&port, "port", "p", 2222, "Port of the nixinit-server on the bootstrap instances")
+}
+
+// bootstrapListEntry describes a bootstrap instance in the output of
+// list-bootstraps.
+type bootstrapListEntry struct {
+	Name          string    `json:"name" yaml:"name"`
+	UUID          string    `json:"uuid" yaml:"uuid"`
+	InstanceID    string    `json:"instance_id" yaml:"instance_id"`
+	State         string    `json:"state" yaml:"state"`
+	IP            string    `json:"ip,omitempty" yaml:"ip,omitempty"`
+	Created       time.Time `json:"created" yaml:"created"`
+	Uptime        string    `json:"uptime,omitempty" yaml:"uptime,omitempty"`
+	Memory        uint64    `json:"memory_mib" yaml:"memory_mib"`
+	VCPUs         uint16    `json:"vcpus" yaml:"vcpus"`
+	Image         string    `json:"image" yaml:"image"`
+	ClientVersion string    `json:"client_version" yaml:"client_version"`
+	ServerState   string    `json:"server_state,omitempty" yaml:"server_state,omitempty"`
+}
+
+// newBootstrapListEntries describes vms, fetching the state of the
+// nixinit-server of each running instance concurrently.
+func newBootstrapListEntries(vms []bootstrapVM, serverPort int) []bootstrapListEntry {
+	entries := make([]bootstrapListEntry, len(vms))
+
+	var wg sync.WaitGroup
+	for i, vm := range vms {
+		entries[i] = bootstrapListEntry{
+			Name:          vm.Name,
+			UUID:          vm.UUID,
+			InstanceID:    vm.Metadata.InstanceID,
+			State:         vm.State,
+			IP:            vm.IP,
+			Created:       vm.Metadata.Created,
+			Memory:        vm.Memory,
+			VCPUs:         vm.VCPUs,
+			Image:         vm.Metadata.Image,
+			ClientVersion: vm.Metadata.ClientVersion,
+		}
+		if vm.IP == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(entry *bootstrapListEntry) {
+			defer wg.Done()
+			status, err := getServerStatus(entry.IP, serverPort)
+			if err != nil {
+				pterm.Debug.Printf("failed to get server status of %s: %v\n", entry.Name, err)
+				entry.ServerState = "UNREACHABLE"
+				return
+			}
+			entry.ServerState = status.ServerStatus
+			// instances reboot once a configuration is applied, so the uptime
+			// is the one reported by the instance rather than the time since
+			// it was created
+			entry.Uptime = status.SystemUptime
+		}(&entries[i])
+	}
+	wg.Wait()
+
+	return entries
+}
+
+// printBootstrapTable prints entries as a table.
+func printBootstrapTable(entries []bootstrapListEntry) error {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	data := pterm.TableData{{"NAME", "UUID", "INSTANCE ID", "STATE", "IP", "UPTIME", "MEMORY", "VCPUS", "SERVER STATE"}}
+	for _, entry := range entries {
+		data = append(data, []string{
+			entry.Name,
+			entry.UUID,
+			entry.InstanceID,
+			entry.State,
+			orDash(entry.IP),
+			orDash(entry.Uptime),
+			fmt.Sprintf("%d MiB", entry.Memory),
+			fmt.Sprintf("%d", entry.VCPUs),
+			orDash(entry.ServerState),
+		})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(data).Render()
 }
 
 func listBootstraps(cmd *cobra.Command, args []string) {
-	bootstrapVMs, _ := getBootstrapVMs()
-	if len(bootstrapVMs) == 0 {
-		log.Printf("No bootstrap VMs found.\n")
+	if listOutput != "table" && listOutput != "json" && listOutput != "yaml" {
+		pterm.Error.Printf("Unsupported --output %q - must be table, json or yaml\n", listOutput)
+		return
+	}
+
+	l, err := connectLibvirt()
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
 		return
 	}
+	defer l.Disconnect()
 
-	for _, vm := range bootstrapVMs {
-		log.Printf("Bootstrap VM ID: %s\n", vm)
+	bootstrapVMs, err := getBootstrapVMs(l)
+	if err != nil {
+		pterm.Error.Printf("Failed to list bootstrap VMs: %v\n", err)
+		return
+	}
+	entries := newBootstrapListEntries(bootstrapVMs, port)
+
+	switch listOutput {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(entries)
+	case "yaml":
+		err = yaml.NewEncoder(os.Stdout).Encode(entries)
+	default:
+		if len(entries) == 0 {
+			pterm.Info.Printf("No bootstrap VMs found.\n")
+			return
+		}
+		err = printBootstrapTable(entries)
+	}
+	if err != nil {
+		pterm.Error.Printf("Failed to print bootstrap VMs: %v\n", err)
 	}
 }
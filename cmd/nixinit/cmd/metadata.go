@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+const (
+	// nixinitMetadataNamespace is the namespace of the element which nixinit
+	// adds to the metadata of the domains it creates; domains without it are
+	// ignored by nixinit.
+	nixinitMetadataNamespace = "https://github.com/seanrmurphy/nixinit/libvirt/1.0"
+	nixinitMetadataPrefix    = "nixinit"
+)
+
+// nixinitMetadata is the nixinit element of the domain metadata; it records
+// what nixinit knows about an instance so that later invocations of the
+// client, on any machine, can find it.
+//
+//	<nixinit:instance xmlns:nixinit="...">
+//	  <nixinit:id>...</nixinit:id>
+//	  <nixinit:created>2024-01-02T15:04:05Z</nixinit:created>
+//	  <nixinit:image>nixinit-bootstrap.qcow2</nixinit:image>
+//	  <nixinit:seed-iso pool="nixinit-iso">cidata-....iso</nixinit:seed-iso>
+//	  <nixinit:client-version>...</nixinit:client-version>
+//	</nixinit:instance>
+type nixinitMetadata struct {
+	XMLName       xml.Name    `xml:"instance"`
+	InstanceID    string      `xml:"id"`
+	Created       time.Time   `xml:"created"`
+	Image         string      `xml:"image"`
+	SeedISO       seedISOInfo `xml:"seed-iso"`
+	ClientVersion string      `xml:"client-version"`
+}
+
+// seedISOInfo identifies the seed ISO volume of an instance.
+type seedISOInfo struct {
+	Pool   string `xml:"pool,attr"`
+	Volume string `xml:",chardata"`
+}
+
+// metadataXML returns the metadata element of the domain XML. The elements
+// are written with an explicit namespace prefix, which libvirt requires for
+// custom metadata.
+func (m nixinitMetadata) metadataXML() string {
+	var builder strings.Builder
+	element := func(name, attrs, value string) {
+		fmt.Fprintf(&builder, "\n          <%s:%s%s>", nixinitMetadataPrefix, name, attrs)
+		_ = xml.EscapeText(&builder, []byte(value))
+		fmt.Fprintf(&builder, "</%s:%s>", nixinitMetadataPrefix, name)
+	}
+
+	fmt.Fprintf(&builder, "<metadata>\n        <%[1]s:instance xmlns:%[1]s='%[2]s'>", nixinitMetadataPrefix, nixinitMetadataNamespace)
+	element("id", "", m.InstanceID)
+	element("created", "", m.Created.UTC().Format(time.RFC3339))
+	element("image", "", m.Image)
+	element("seed-iso", fmt.Sprintf(" pool='%s'", m.SeedISO.Pool), m.SeedISO.Volume)
+	element("client-version", "", m.ClientVersion)
+	fmt.Fprintf(&builder, "\n        </%s:instance>\n      </metadata>", nixinitMetadataPrefix)
+	return builder.String()
+}
+
+// parseNixinitMetadata parses the nixinit element of the domain metadata.
+func parseNixinitMetadata(element string) (*nixinitMetadata, error) {
+	var metadata nixinitMetadata
+	if err := xml.Unmarshal([]byte(element), &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.InstanceID == "" {
+		return nil, fmt.Errorf("no instance ID")
+	}
+	return &metadata, nil
+}
+
+// getNixinitMetadata returns the nixinit metadata of dom, or nil if dom was
+// not created by nixinit.
+func getNixinitMetadata(l *libvirt.Libvirt, dom libvirt.Domain) (*nixinitMetadata, error) {
+	element, err := l.DomainGetMetadata(dom, int32(libvirt.DomainMetadataElement), libvirt.OptString{nixinitMetadataNamespace}, 0)
+	if err != nil {
+		if libvirtErr, ok := err.(libvirt.Error); ok && libvirtErr.Code == uint32(libvirt.ErrNoDomainMetadata) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get metadata of domain %s: %v", dom.Name, err)
+	}
+
+	metadata, err := parseNixinitMetadata(element)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of domain %s: %v", dom.Name, err)
+	}
+	return metadata, nil
+}
+
+// isoVolumeName returns the name of the seed ISO volume of an instance.
+func isoVolumeName(instanceID string) string {
+	return fmt.Sprintf("%s-%s.iso", isoImageName, instanceID)
+}
+
+// defaultDomainName returns the name of the domain of an instance if no name
+// is given.
+func defaultDomainName(instanceID string) string {
+	return "nixinit-" + instanceID[:8]
+}
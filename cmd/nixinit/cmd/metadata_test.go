@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	metadata := nixinitMetadata{
+		InstanceID:    "0b7b4a9e-6d2c-4d55-9f41-3c1a2e8d7f60",
+		Created:       time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC),
+		Image:         "nixinit-bootstrap.qcow2",
+		SeedISO:       seedISOInfo{Pool: nixinitIsoPoolName, Volume: isoVolumeName("0b7b4a9e-6d2c-4d55-9f41-3c1a2e8d7f60")},
+		ClientVersion: "v1.2.3<dirty>",
+	}
+
+	domainXML := metadata.metadataXML()
+	if !strings.Contains(domainXML, "xmlns:nixinit='"+nixinitMetadataNamespace+"'") {
+		t.Fatalf("expected the nixinit namespace to be declared, got:\n%s", domainXML)
+	}
+
+	// libvirt returns the nixinit element on its own
+	var parsed struct {
+		Instance nixinitMetadata `xml:"instance"`
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &parsed); err != nil {
+		t.Fatalf("failed to parse metadata:\n%s\n%v", domainXML, err)
+	}
+	parsed.Instance.XMLName = xml.Name{}
+	if parsed.Instance != metadata {
+		t.Errorf("expected %+v, got %+v", metadata, parsed.Instance)
+	}
+
+	if _, err := parseNixinitMetadata("<instance xmlns='" + nixinitMetadataNamespace + "'/>"); err == nil {
+		t.Errorf("expected metadata without an instance ID to be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	nixpkgsChannel    string
+	nixpkgsRev        string
+	nixpkgsNarHash    string
+	stateVersion      string
+	flakeLockFilename string
+	lockFlake         bool
+)
+
+var (
+	// nixpkgsFilename is the name of the file which selects the nixpkgs used by
+	// the flake generated on the server.
+	nixpkgsFilename = "nixpkgs.yaml"
+	// remoteFlakeLockFilename is the name under which a lock file for the
+	// generated flake is uploaded.
+	remoteFlakeLockFilename = "flake.lock"
+	defaultNixpkgsChannel   = "nixos-24.05"
+)
+
+var nixosChannelPattern = regexp.MustCompile(`^nixos-(\d\d\.\d\d|unstable)$`)
+
+// NixpkgsSource selects the nixpkgs used by the flake generated on the server:
+// either a channel or a revision pinned by its NAR hash.
+type NixpkgsSource struct {
+	Channel      string `yaml:"channel,omitempty"`
+	Rev          string `yaml:"rev,omitempty"`
+	NarHash      string `yaml:"nar_hash,omitempty"`
+	StateVersion string `yaml:"state_version,omitempty"`
+}
+
+// getNixpkgsSource builds the nixpkgs source from the command line flags; it
+// returns nil if the server default should be used.
+func getNixpkgsSource() (*NixpkgsSource, error) {
+	if nixpkgsChannel != "" && nixpkgsRev != "" {
+		return nil, fmt.Errorf("only one of --nixpkgs-channel and --nixpkgs-rev may be set")
+	}
+	if nixpkgsRev != "" && nixpkgsNarHash == "" {
+		return nil, fmt.Errorf("--nixpkgs-rev requires --nixpkgs-nar-hash")
+	}
+	if nixpkgsRev == "" && nixpkgsNarHash != "" {
+		return nil, fmt.Errorf("--nixpkgs-nar-hash requires --nixpkgs-rev")
+	}
+	if nixpkgsChannel != "" && !nixosChannelPattern.MatchString(nixpkgsChannel) {
+		return nil, fmt.Errorf("--nixpkgs-channel must be of the form nixos-YY.MM or nixos-unstable")
+	}
+
+	if nixpkgsChannel == "" && nixpkgsRev == "" && stateVersion == "" {
+		return nil, nil
+	}
+	return &NixpkgsSource{
+		Channel:      nixpkgsChannel,
+		Rev:          nixpkgsRev,
+		NarHash:      nixpkgsNarHash,
+		StateVersion: stateVersion,
+	}, nil
+}
+
+// stateVersionForChannel returns the release of channel, or the release of the
+// default channel for nixos-unstable.
+func stateVersionForChannel(channel string) string {
+	if channel == "" {
+		channel = defaultNixpkgsChannel
+	}
+	match := nixosChannelPattern.FindStringSubmatch(channel)
+	if match == nil || match[1] == "unstable" {
+		match = nixosChannelPattern.FindStringSubmatch(defaultNixpkgsChannel)
+	}
+	return match[1]
+}
+
+// flakeURL returns the nixpkgs input url used by the server for source; this
+// must match the url in the server's flake template for a lock file generated
+// by the client to be used as is.
+func (s *NixpkgsSource) flakeURL() string {
+	switch {
+	case s == nil || (s.Channel == "" && s.Rev == ""):
+		return "github:nixos/nixpkgs/" + defaultNixpkgsChannel
+	case s.Rev != "":
+		return "github:nixos/nixpkgs/" + s.Rev + "?narHash=" + url.QueryEscape(s.NarHash)
+	default:
+		return "github:nixos/nixpkgs/" + s.Channel
+	}
+}
+
+// generateFlakeLock locks the inputs of the flake generated on the server with
+// the local nix, so that the remote build uses exactly the same inputs.
+func generateFlakeLock(source *NixpkgsSource, install bool) ([]byte, error) {
+	directory, err := os.MkdirTemp("", "nixinit-flake-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(directory)
+
+	// only the inputs matter for the lock file; they must match the inputs of
+	// the flake generated by the server
+	var inputs strings.Builder
+	fmt.Fprintf(&inputs, "    nixpkgs.url = %q;\n", source.flakeURL())
+	if install {
+		inputs.WriteString("    disko = {\n      url = \"github:nix-community/disko\";\n      inputs.nixpkgs.follows = \"nixpkgs\";\n    };\n")
+	}
+	flake := fmt.Sprintf("{\n  inputs = {\n%s  };\n\n  outputs = { ... }: { };\n}\n", inputs.String())
+	if err := os.WriteFile(filepath.Join(directory, "flake.nix"), []byte(flake), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write flake.nix: %v", err)
+	}
+
+	cmd := exec.Command("nix", "--extra-experimental-features", "nix-command flakes", "flake", "lock", directory)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to lock flake: %v: %s", err, output)
+	}
+
+	cleanedFilename := filepath.Clean(filepath.Join(directory, "flake.lock"))
+	lock, err := os.ReadFile(cleanedFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read flake.lock: %v", err)
+	}
+	return lock, nil
+}
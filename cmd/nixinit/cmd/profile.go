@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BootstrapProfile describes the bootstrap VM to launch; it can be read from
+// a profile file with --profile, and any flags set on the command line
+// override the values in the file.
+type BootstrapProfile struct {
+	// Name is the name of the domain; it defaults to nixinit-<instance ID
+	// prefix>.
+	Name string `yaml:"name,omitempty"`
+	Arch string `yaml:"arch,omitempty"`
+	// Memory is the memory of the VM in MiB.
+	Memory uint64 `yaml:"memory,omitempty"`
+	VCPUs  uint   `yaml:"vcpus,omitempty"`
+	// DiskSize is the capacity of the VM's disk in GiB.
+	DiskSize uint64 `yaml:"disk_size,omitempty"`
+	// Image is the name of the base image in the nixinit-volume pool; it
+	// defaults to the bootstrap image for the architecture.
+	Image   string `yaml:"image,omitempty"`
+	Network string `yaml:"network,omitempty"`
+	// Machine is the machine type of the VM; it defaults to the machine type
+	// for the architecture.
+	Machine string `yaml:"machine,omitempty"`
+}
+
+var defaultBootstrapProfile = BootstrapProfile{
+	Arch:     "x86_64",
+	Memory:   4096,
+	VCPUs:    2,
+	DiskSize: 10,
+	Network:  "default",
+}
+
+const (
+	minBootstrapMemory   = 1024
+	maxBootstrapVCPUs    = 64
+	minBootstrapDiskSize = 4
+	maxBootstrapDiskSize = 4096
+)
+
+var (
+	domainNamePattern  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+	imageNamePattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*\.qcow2$`)
+	machineTypePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+)
+
+// readBootstrapProfile reads a profile file; unset values are left empty.
+func readBootstrapProfile(filename string) (BootstrapProfile, error) {
+	var profile BootstrapProfile
+
+	cleanedFilename := filepath.Clean(filename)
+	data, err := os.ReadFile(cleanedFilename)
+	if err != nil {
+		return profile, fmt.Errorf("failed to read profile: %v", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&profile); err != nil {
+		return profile, fmt.Errorf("failed to parse profile %s: %v", filename, err)
+	}
+	return profile, nil
+}
+
+// merge returns p with the unset values taken from defaults.
+func (p BootstrapProfile) merge(defaults BootstrapProfile) BootstrapProfile {
+	if p.Name == "" {
+		p.Name = defaults.Name
+	}
+	if p.Arch == "" {
+		p.Arch = defaults.Arch
+	}
+	if p.Memory == 0 {
+		p.Memory = defaults.Memory
+	}
+	if p.VCPUs == 0 {
+		p.VCPUs = defaults.VCPUs
+	}
+	if p.DiskSize == 0 {
+		p.DiskSize = defaults.DiskSize
+	}
+	if p.Image == "" {
+		p.Image = defaults.Image
+	}
+	if p.Network == "" {
+		p.Network = defaults.Network
+	}
+	if p.Machine == "" {
+		p.Machine = defaults.Machine
+	}
+	return p
+}
+
+// changedFlags returns a profile containing only the values of the flags for
+// which changed, ie cmd.Flags().Changed, is true.
+func (p BootstrapProfile) changedFlags(changed func(name string) bool) BootstrapProfile {
+	var result BootstrapProfile
+	if changed("name") {
+		result.Name = p.Name
+	}
+	if changed("arch") {
+		result.Arch = p.Arch
+	}
+	if changed("memory") {
+		result.Memory = p.Memory
+	}
+	if changed("vcpus") {
+		result.VCPUs = p.VCPUs
+	}
+	if changed("disk-size") {
+		result.DiskSize = p.DiskSize
+	}
+	if changed("image") {
+		result.Image = p.Image
+	}
+	if changed("network") {
+		result.Network = p.Network
+	}
+	if changed("machine") {
+		result.Machine = p.Machine
+	}
+	return result
+}
+
+// validate checks the profile before any libvirt resources are created.
+func (p BootstrapProfile) validate() error {
+	if p.Name != "" && !domainNamePattern.MatchString(p.Name) {
+		return fmt.Errorf("invalid name %q - must be up to 63 letters, digits, '.', '_' or '-'", p.Name)
+	}
+	if _, ok := guestArchitectures[p.Arch]; !ok {
+		return fmt.Errorf("unsupported arch %q - must be x86_64 or aarch64", p.Arch)
+	}
+	if p.Memory < minBootstrapMemory {
+		return fmt.Errorf("memory must be at least %d MiB, got %d", minBootstrapMemory, p.Memory)
+	}
+	if p.VCPUs < 1 || p.VCPUs > maxBootstrapVCPUs {
+		return fmt.Errorf("vcpus must be between 1 and %d, got %d", maxBootstrapVCPUs, p.VCPUs)
+	}
+	if p.DiskSize < minBootstrapDiskSize || p.DiskSize > maxBootstrapDiskSize {
+		return fmt.Errorf("disk size must be between %d and %d GiB, got %d", minBootstrapDiskSize, maxBootstrapDiskSize, p.DiskSize)
+	}
+	if p.Image != "" && !imageNamePattern.MatchString(p.Image) {
+		return fmt.Errorf("invalid image %q - must be the name of a .qcow2 volume", p.Image)
+	}
+	if !domainNamePattern.MatchString(p.Network) {
+		return fmt.Errorf("invalid network %q", p.Network)
+	}
+	if p.Machine != "" && !machineTypePattern.MatchString(p.Machine) {
+		return fmt.Errorf("invalid machine type %q", p.Machine)
+	}
+	return nil
+}
+
+// guestArchitecture returns the architecture of the profile with the image
+// and machine type overridden by the profile.
+func (p BootstrapProfile) guestArchitecture() guestArchitecture {
+	arch := guestArchitectures[p.Arch]
+	if p.Image != "" {
+		arch.ImageName = p.Image
+	}
+	if p.Machine != "" {
+		arch.Machine = p.Machine
+	}
+	return arch
+}
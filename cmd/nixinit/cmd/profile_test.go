@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestBootstrapProfilePrecedence(t *testing.T) {
+	profileFile := filepath.Join(t.TempDir(), "profile.yaml")
+	profileData := "name: builder\nmemory: 16384\nvcpus: 8\n"
+	if err := os.WriteFile(profileFile, []byte(profileData), 0600); err != nil {
+		t.Fatalf("failed to write profile: %v", err)
+	}
+
+	previousFlags, previousFilename := bootstrapFlags, profileFilename
+	t.Cleanup(func() {
+		bootstrapFlags, profileFilename = previousFlags, previousFilename
+	})
+
+	cmd := &cobra.Command{}
+	cmd.Flags().UintVar(&bootstrapFlags.VCPUs, "vcpus", defaultBootstrapProfile.VCPUs, "")
+	cmd.Flags().Uint64Var(&bootstrapFlags.Memory, "memory", defaultBootstrapProfile.Memory, "")
+	if err := cmd.Flags().Parse([]string{"--vcpus", "4"}); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+	profileFilename = profileFile
+
+	profile, err := getBootstrapProfile(cmd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the flag overrides the file, which overrides the defaults
+	if profile.VCPUs != 4 || profile.Memory != 16384 || profile.Name != "builder" || profile.DiskSize != defaultBootstrapProfile.DiskSize {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+}
+
+func TestInvalidBootstrapProfilesAreRejected(t *testing.T) {
+	tests := map[string]BootstrapProfile{
+		"name":      {Name: "../nixinit"},
+		"arch":      {Arch: "riscv64"},
+		"memory":    {Memory: 512},
+		"vcpus":     {VCPUs: 1000},
+		"disk size": {DiskSize: 1},
+		"image":     {Image: "/tmp/image.qcow2"},
+		"network":   {Network: "default'/><x"},
+		"machine":   {Machine: "q35'"},
+	}
+	for field, profile := range tests {
+		err := profile.merge(defaultBootstrapProfile).validate()
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("expected invalid %s to be rejected, got %v", field, err)
+		}
+	}
+
+	if err := defaultBootstrapProfile.validate(); err != nil {
+		t.Errorf("expected the default profile to be valid, got %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// orphanGracePeriod is how long after it was last modified a volume is left
+// alone by prune: a bootstrap which is still launching has created its seed ISO
+// and disk but not yet the domain they are attached to.
+var orphanGracePeriod = 15 * time.Minute
+
+// orphanVolume is a volume created by nixinit whose domain no longer exists.
+type orphanVolume struct {
+	Pool string
+	Name string
+	Path string
+}
+
+// getDomainSourceFiles returns the files backing all disks of dom, including
+// cdroms.
+func getDomainSourceFiles(l *libvirt.Libvirt, dom libvirt.Domain) ([]string, error) {
+	xmlDesc, err := l.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain XML description: %v", err)
+	}
+
+	var domainXML DomainXML
+	err = xml.Unmarshal([]byte(xmlDesc), &domainXML)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %v", err)
+	}
+
+	var files []string
+	for _, disk := range domainXML.Devices.Disks {
+		if disk.Type == "file" && disk.Source.File != "" {
+			files = append(files, disk.Source.File)
+		}
+	}
+	return files, nil
+}
+
+// volumeDescription is the part of the XML description of a volume used by
+// prune.
+type volumeDescription struct {
+	// BackingStore is set if the volume is backed by another volume, ie it
+	// is the disk of a bootstrap rather than a base image.
+	BackingStore string `xml:"backingStore>path"`
+	// Modified and Changed are the mtime and ctime of the volume, in seconds
+	// since the epoch; they are only reported for file based pools.
+	Modified string `xml:"target>timestamps>mtime"`
+	Changed  string `xml:"target>timestamps>ctime"`
+}
+
+// getVolumeDescription returns the description of vol.
+func getVolumeDescription(l *libvirt.Libvirt, vol libvirt.StorageVol) (volumeDescription, error) {
+	var description volumeDescription
+	xmlDesc, err := l.StorageVolGetXMLDesc(vol, 0)
+	if err != nil {
+		return description, fmt.Errorf("failed to get XML description of volume %s: %v", vol.Name, err)
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &description); err != nil {
+		return description, fmt.Errorf("failed to parse XML description of volume %s: %v", vol.Name, err)
+	}
+	return description, nil
+}
+
+// parseVolumeTimestamp parses a libvirt volume timestamp, which is seconds
+// since the epoch with an optional fraction.
+func parseVolumeTimestamp(timestamp string) (time.Time, error) {
+	seconds, fraction, _ := strings.Cut(timestamp, ".")
+	secs, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	var nsecs int64
+	if fraction != "" {
+		fraction = (fraction + "000000000")[:9]
+		if nsecs, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+	}
+	return time.Unix(secs, nsecs), nil
+}
+
+// isRecent returns true if the volume was modified within orphanGracePeriod of
+// now, or if its age cannot be told, so that prune errs on the side of keeping
+// it.
+func (d volumeDescription) isRecent(now time.Time) bool {
+	var latest time.Time
+	for _, timestamp := range []string{d.Modified, d.Changed} {
+		t, err := parseVolumeTimestamp(timestamp)
+		if err != nil {
+			continue
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest.IsZero() || now.Sub(latest) < orphanGracePeriod
+}
+
+// findOrphanVolumes returns the seed ISOs in the nixinit-iso pool and the
+// bootstrap disks in the nixinit-volume pool which are not attached to any
+// domain. Base images, and volumes modified within orphanGracePeriod, which
+// may belong to a bootstrap which is still launching, are never returned.
+func findOrphanVolumes(l *libvirt.Libvirt) ([]orphanVolume, error) {
+	now := time.Now()
+
+	// files attached to any domain, not just those created by nixinit, are in
+	// use
+	domains, _, err := l.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+	attached := map[string]bool{}
+	for _, dom := range domains {
+		files, err := getDomainSourceFiles(l, dom)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			attached[file] = true
+		}
+	}
+
+	var orphans []orphanVolume
+	for _, poolName := range []string{nixinitIsoPoolName, nixinitVolumePoolName} {
+		pool, err := l.StoragePoolLookupByName(poolName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lookup storage pool %s: %v", poolName, err)
+		}
+		vols, _, err := l.StoragePoolListAllVolumes(pool, 1, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list volumes in pool %s: %v", poolName, err)
+		}
+
+		for _, vol := range vols {
+			path, err := l.StorageVolGetPath(vol)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get path of volume %s: %v", vol.Name, err)
+			}
+			if attached[path] {
+				continue
+			}
+
+			description, err := getVolumeDescription(l, vol)
+			if err != nil {
+				return nil, err
+			}
+			var created bool
+			if poolName == nixinitIsoPoolName {
+				created = strings.HasPrefix(vol.Name, isoImageName+"-") && strings.HasSuffix(vol.Name, ".iso")
+			} else {
+				created = description.BackingStore != ""
+			}
+			if created && description.isRecent(now) {
+				log.Printf("Keeping volume %s in pool %s as it may belong to a bootstrap which is still launching", vol.Name, poolName)
+				continue
+			}
+			if created {
+				orphans = append(orphans, orphanVolume{Pool: poolName, Name: vol.Name, Path: path})
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// removeOrphanVolumes deletes the given volumes, continuing past failures.
+func removeOrphanVolumes(l *libvirt.Libvirt, orphans []orphanVolume) error {
+	var failed int
+	for _, orphan := range orphans {
+		if err := removeVolume(l, orphan.Path); err != nil {
+			log.Printf("Error removing volume %s from pool %s: %v", orphan.Name, orphan.Pool, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d of %d volumes", failed, len(orphans))
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+const testVolumeXML = `<volume type='file'>
+  <name>nixinit-abc-nixinit-bootstrap.qcow2</name>
+  <target>
+    <path>/var/lib/libvirt/images/nixinit/volume/nixinit-abc-nixinit-bootstrap.qcow2</path>
+    <format type='qcow2'/>
+    <timestamps>
+      <atime>1700000100.5</atime>
+      <mtime>1700000000.25</mtime>
+      <ctime>1700000060.123456789</ctime>
+    </timestamps>
+  </target>
+  <backingStore>
+    <path>/var/lib/libvirt/images/nixinit/volume/nixinit-bootstrap.qcow2</path>
+    <format type='qcow2'/>
+  </backingStore>
+</volume>`
+
+func TestVolumeDescription(t *testing.T) {
+	var description volumeDescription
+	if err := xml.Unmarshal([]byte(testVolumeXML), &description); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if description.BackingStore == "" {
+		t.Errorf("expected the backing store to be parsed")
+	}
+
+	changed := time.Unix(1700000060, 123456789)
+	tests := []struct {
+		name        string
+		description volumeDescription
+		now         time.Time
+		recent      bool
+	}{
+		{"just changed", description, changed.Add(time.Minute), true},
+		{"within grace period", description, changed.Add(orphanGracePeriod - time.Second), true},
+		{"after grace period", description, changed.Add(orphanGracePeriod), false},
+		{"no timestamps", volumeDescription{BackingStore: "/base.qcow2"}, changed.Add(24 * time.Hour), true},
+		{"invalid timestamps", volumeDescription{Modified: "yesterday"}, changed.Add(24 * time.Hour), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if recent := test.description.isRecent(test.now); recent != test.recent {
+				t.Errorf("expected isRecent to be %v, got %v", test.recent, recent)
+			}
+		})
+	}
+}
+
+func TestParseVolumeTimestamp(t *testing.T) {
+	tests := []struct {
+		timestamp string
+		expected  time.Time
+		valid     bool
+	}{
+		{"1700000000", time.Unix(1700000000, 0), true},
+		{"1700000000.25", time.Unix(1700000000, 250000000), true},
+		{"1700000000.123456789", time.Unix(1700000000, 123456789), true},
+		{"", time.Time{}, false},
+		{"1700000000.x", time.Time{}, false},
+	}
+	for _, test := range tests {
+		parsed, err := parseVolumeTimestamp(test.timestamp)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid to be %v, got error %v", test.timestamp, test.valid, err)
+			continue
+		}
+		if test.valid && !parsed.Equal(test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.timestamp, test.expected, parsed)
+		}
+	}
+}
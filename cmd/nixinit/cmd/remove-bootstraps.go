@@ -2,20 +2,35 @@
 package cmd
 
 import (
-	"log"
+	"fmt"
+	"strings"
 
+	"github.com/digitalocean/go-libvirt"
+	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 )
 
 // removeBootstrapsCmd represents the removeBootstraps command
 var removeBootstrapsCmd = &cobra.Command{
-	Use:   "remove-bootstraps",
-	Short: "Removes an existing nixinit bootstrap machine",
-	Long:  `Removes an existing nixinit bootstrap machine`,
-	Run:   removeBootstraps,
+	Use:   "remove-bootstraps [name | instance ID | UUID]...",
+	Short: "Removes existing nixinit bootstrap machines",
+	Long: `Removes existing nixinit bootstrap machines, together with their disks and
+seed ISOs.
+
+Bootstraps are selected by domain name, nixinit instance ID or libvirt UUID, or
+all of them with --all. With --prune, seed ISOs and bootstrap disks in the
+nixinit-iso and nixinit-volume pools which no longer belong to any domain are
+removed as well, unless they were modified in the last 15 minutes and so may
+belong to a bootstrap which is still launching.`,
+	Run: removeBootstraps,
 }
 
-var removeInstanceID string
+var (
+	removeInstanceID string
+	removeAll        bool
+	removeYes        bool
+	removePrune      bool
+)
 
 func init() {
 	rootCmd.AddCommand(removeBootstrapsCmd)
@@ -28,17 +43,144 @@ func init() {
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
-	removeBootstrapsCmd.Flags().StringVarP(&removeInstanceID, "instance-id", "i", "", "ID of instance to be removed")
+	removeBootstrapsCmd.Flags().StringVarP(&removeInstanceID, "instance-id", "i", "", "Name, nixinit instance ID or UUID of instance to be removed")
+	removeBootstrapsCmd.Flags().BoolVar(&removeAll, "all", false, "Remove all bootstrap machines")
+	removeBootstrapsCmd.Flags().BoolVarP(&removeYes, "yes", "y", false, "Do not ask for confirmation")
+	removeBootstrapsCmd.Flags().BoolVar(&removePrune, "prune", false, "Remove nixinit volumes which no longer belong to any domain")
+}
+
+// matchesBootstrap returns true if selector is the name, nixinit instance ID
+// or libvirt UUID (with or without dashes) of vm.
+func matchesBootstrap(vm bootstrapVM, selector string) bool {
+	normalizedUUID := strings.ReplaceAll(vm.UUID, "-", "")
+	return selector == vm.Name || selector == vm.Metadata.InstanceID ||
+		strings.EqualFold(strings.ReplaceAll(selector, "-", ""), normalizedUUID)
+}
+
+// selectBootstraps returns the bootstraps matching selectors, or all of them
+// if all is set; each selector must match exactly one bootstrap.
+func selectBootstraps(vms []bootstrapVM, selectors []string, all bool) ([]bootstrapVM, error) {
+	if all {
+		return vms, nil
+	}
+
+	var selected []bootstrapVM
+	seen := map[string]bool{}
+	for _, selector := range selectors {
+		var matches []bootstrapVM
+		for _, vm := range vms {
+			if matchesBootstrap(vm, selector) {
+				matches = append(matches, vm)
+			}
+		}
+		switch {
+		case len(matches) == 0:
+			return nil, fmt.Errorf("no bootstrap VM matches %q", selector)
+		case len(matches) > 1:
+			return nil, fmt.Errorf("%q matches %d bootstrap VMs", selector, len(matches))
+		}
+		if !seen[matches[0].UUID] {
+			seen[matches[0].UUID] = true
+			selected = append(selected, matches[0])
+		}
+	}
+	return selected, nil
+}
+
+// confirm asks the user to confirm an action unless --yes was given.
+func confirm(question string) bool {
+	if removeYes {
+		return true
+	}
+	confirmed, err := pterm.DefaultInteractiveConfirm.WithDefaultText(question).Show()
+	if err != nil {
+		pterm.Error.Printf("Failed to read confirmation: %v\n", err)
+		return false
+	}
+	return confirmed
 }
 
 func removeBootstraps(cmd *cobra.Command, args []string) {
-	if removeInstanceID == "" {
-		log.Println("Instance ID is required to remove bootstrap - exiting... ")
+	selectors := args
+	if removeInstanceID != "" {
+		selectors = append(selectors, removeInstanceID)
+	}
+	if len(selectors) == 0 && !removeAll && !removePrune {
+		pterm.Error.Println("A bootstrap name, instance ID or UUID, --all or --prune is required - exiting... ")
+		return
+	}
+	if len(selectors) > 0 && removeAll {
+		pterm.Error.Println("Bootstraps cannot be selected together with --all - exiting... ")
+		return
+	}
+
+	l, err := connectLibvirt()
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
 		return
 	}
+	defer l.Disconnect()
+
+	if len(selectors) > 0 || removeAll {
+		bootstrapVMs, err := getBootstrapVMs(l)
+		if err != nil {
+			pterm.Error.Printf("Failed to list bootstrap VMs: %v\n", err)
+			return
+		}
+		selected, err := selectBootstraps(bootstrapVMs, selectors, removeAll)
+		if err != nil {
+			pterm.Error.Printf("%v - exiting...\n", err)
+			return
+		}
+
+		if len(selected) == 0 {
+			pterm.Info.Println("No bootstrap VMs found.")
+		} else {
+			for _, vm := range selected {
+				pterm.Info.Printf("Will remove %s (instance ID: %s, UUID: %s)\n", vm.Name, vm.Metadata.InstanceID, vm.UUID)
+			}
+			if !confirm(fmt.Sprintf("Remove %d bootstrap VM(s)?", len(selected))) {
+				pterm.Info.Println("Nothing removed.")
+				return
+			}
+			for _, vm := range selected {
+				if err := removeInstance(l, vm.UUID); err != nil {
+					pterm.Error.Printf("Error removing bootstrap VM %s: %v\n", vm.Name, err)
+					continue
+				}
+				pterm.Success.Printf("Removed bootstrap VM %s\n", vm.Name)
+			}
+		}
+	}
+
+	if removePrune {
+		pruneVolumes(l)
+	}
+}
 
-	err := removeInstance(removeInstanceID)
+// pruneVolumes removes the nixinit volumes which no longer belong to any
+// domain.
+func pruneVolumes(l *libvirt.Libvirt) {
+	orphans, err := findOrphanVolumes(l)
 	if err != nil {
-		log.Printf("Error removing bootstrap VM: %v", err)
+		pterm.Error.Printf("Failed to find orphaned volumes: %v\n", err)
+		return
+	}
+	if len(orphans) == 0 {
+		pterm.Info.Println("No orphaned volumes found.")
+		return
+	}
+
+	for _, orphan := range orphans {
+		pterm.Info.Printf("Will remove orphaned volume %s from pool %s\n", orphan.Name, orphan.Pool)
+	}
+	if !confirm(fmt.Sprintf("Remove %d orphaned volume(s)?", len(orphans))) {
+		pterm.Info.Println("Nothing removed.")
+		return
+	}
+	if err := removeOrphanVolumes(l, orphans); err != nil {
+		pterm.Error.Printf("%v\n", err)
+		return
 	}
+	pterm.Success.Printf("Removed %d orphaned volume(s)\n", len(orphans))
 }
@@ -0,0 +1,27 @@
+package cmd
+
+import "testing"
+
+func TestSelectBootstraps(t *testing.T) {
+	vms := []bootstrapVM{
+		{Name: "nixinit-0b7b4a9e", UUID: "5f0e8c1a-2b3d-4e5f-8a9b-0c1d2e3f4a5b", Metadata: nixinitMetadata{InstanceID: "0b7b4a9e-6d2c-4d55-9f41-3c1a2e8d7f60"}},
+		{Name: "builder", UUID: "9a8b7c6d-5e4f-4a3b-9c2d-1e0f9a8b7c6d", Metadata: nixinitMetadata{InstanceID: "3c1a2e8d-9f41-4d55-6d2c-0b7b4a9e7f60"}},
+	}
+
+	for _, selector := range []string{"builder", "3c1a2e8d-9f41-4d55-6d2c-0b7b4a9e7f60", "9a8b7c6d5e4f4a3b9c2d1e0f9a8b7c6d"} {
+		selected, err := selectBootstraps(vms, []string{selector, selector}, false)
+		if err != nil {
+			t.Fatalf("unexpected error selecting %s: %v", selector, err)
+		}
+		if len(selected) != 1 || selected[0].Name != "builder" {
+			t.Errorf("expected %s to select builder once, got %v", selector, selected)
+		}
+	}
+
+	if _, err := selectBootstraps(vms, []string{"missing"}, false); err == nil {
+		t.Errorf("expected an unknown bootstrap to be rejected")
+	}
+	if selected, _ := selectBootstraps(vms, nil, true); len(selected) != len(vms) {
+		t.Errorf("expected --all to select all bootstraps, got %v", selected)
+	}
+}
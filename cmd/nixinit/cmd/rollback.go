@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"log"
+)
+
+// rollback records the resources created while launching a bootstrap so that
+// they can be removed, in reverse order of creation, if the launch fails.
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	description string
+	undo        func() error
+}
+
+// add registers undo, which removes the resource described by description.
+func (r *rollback) add(description string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{description: description, undo: undo})
+}
+
+// run removes the registered resources in reverse order of creation. It
+// continues past failures, as the remaining resources must still be removed,
+// and reports whether all of them were.
+func (r *rollback) run() bool {
+	ok := true
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		log.Printf("Rolling back: %s", step.description)
+		if err := step.undo(); err != nil {
+			log.Printf("Failed to roll back %s: %v", step.description, err)
+			ok = false
+		}
+	}
+	r.steps = nil
+	return ok
+}
+
+// describe returns the descriptions of the registered resources in order of
+// creation.
+func (r *rollback) describe() []string {
+	descriptions := make([]string, len(r.steps))
+	for i, step := range r.steps {
+		descriptions[i] = step.description
+	}
+	return descriptions
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRollbackUndoesInReverseOrder(t *testing.T) {
+	var undone []string
+	var r rollback
+	for _, resource := range []string{"iso", "volume", "domain"} {
+		resource := resource
+		r.add(resource, func() error {
+			undone = append(undone, resource)
+			if resource == "volume" {
+				return errors.New("volume busy")
+			}
+			return nil
+		})
+	}
+
+	if r.run() {
+		t.Errorf("expected the failed undo to be reported")
+	}
+	// a failure does not stop the remaining resources from being removed
+	if expected := []string{"domain", "volume", "iso"}; !reflect.DeepEqual(undone, expected) {
+		t.Errorf("expected resources to be removed in order %v, got %v", expected, undone)
+	}
+	if len(r.describe()) != 0 {
+		t.Errorf("expected no resources to remain registered, got %v", r.describe())
+	}
+}
@@ -7,10 +7,15 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// version is the version of the client; it is set at build time with
+// -ldflags "-X github.com/seanrmurphy/nixint/cmd/nixinit/cmd.version=...".
+var version = "dev"
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "nixinit",
-	Short: "A tool for initializing a remote nixos instance",
+	Use:     "nixinit",
+	Version: version,
+	Short:   "A tool for initializing a remote nixos instance",
 	Long: `nixinit can be used to launch a bootstrap nixos instance,
 	generate a customized nixos configuration and upload this to the
 	bootstrapped instance.`,
@@ -34,6 +39,10 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.nixinit.yaml)")
+	rootCmd.PersistentFlags().StringVarP(&libvirtURI, "connect", "c", defaultLibvirtURI(), "libvirt connection URI, ie qemu+ssh://user@host/system or qemu:///session (default from LIBVIRT_DEFAULT_URI)")
+	rootCmd.PersistentFlags().StringVar(&imageMirrorURL, "image-mirror", defaultImageMirror(), "Base URL from which bootstrap images are downloaded (default from NIXINIT_IMAGE_MIRROR)")
+	rootCmd.PersistentFlags().StringVar(&imagePublicKey, "image-public-key", os.Getenv("NIXINIT_IMAGE_PUBLIC_KEY"), "Base64 ed25519 key with which the image manifest must be signed (default from NIXINIT_IMAGE_PUBLIC_KEY)")
+	rootCmd.PersistentFlags().BoolVar(&imageOffline, "offline", false, "Use bootstrap images from the local cache without contacting the image mirror")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -0,0 +1,265 @@
+// Package cmd provides the command-line interface for the nixinit-server application.
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// setupCmd represents the setup command
+var setupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "creates the libvirt storage pools used by nixinit",
+	Long: `setup defines, builds, starts and autostarts the nixinit-iso and
+nixinit-volume storage pools under --pool-dir and checks that the network used
+by bootstraps exists and is running. Resources which are already set up are
+left alone, so setup can be run repeatedly.
+
+With --dry-run, the changes which would be made are printed, together with the
+XML of any storage pools which would be defined.`,
+	Run: setup,
+}
+
+var (
+	setupPoolDirectory string
+	setupNetwork       string
+	setupDryRun        bool
+)
+
+const defaultPoolDirectory = "/var/lib/libvirt/images/nixinit"
+
+func init() {
+	rootCmd.AddCommand(setupCmd)
+
+	setupCmd.Flags().StringVar(&setupPoolDirectory, "pool-dir", defaultPoolDirectory, "Directory under which the storage pools are created")
+	setupCmd.Flags().StringVar(&setupNetwork, "network", defaultBootstrapProfile.Network, "libvirt network used by bootstraps")
+	setupCmd.Flags().BoolVar(&setupDryRun, "dry-run", false, "Print the changes which would be made without making them")
+}
+
+// setupAction is a change needed to set up libvirt for nixinit.
+type setupAction struct {
+	description string
+	// xml is the XML of the resource defined by the action, if any.
+	xml string
+	// autostartOnly is set if the action only matters once the host reboots.
+	autostartOnly bool
+	apply         func() error
+}
+
+// storagePoolXML returns the XML of a directory storage pool.
+func storagePoolXML(name, path string) (string, error) {
+	pool := struct {
+		XMLName xml.Name `xml:"pool"`
+		Type    string   `xml:"type,attr"`
+		Name    string   `xml:"name"`
+		Path    string   `xml:"target>path"`
+	}{Type: "dir", Name: name, Path: path}
+
+	data, err := xml.MarshalIndent(pool, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal storage pool XML: %v", err)
+	}
+	return string(data), nil
+}
+
+// isLibvirtError returns true if err is the libvirt error code.
+func isLibvirtError(err error, code libvirt.ErrorNumber) bool {
+	libvirtErr, ok := err.(libvirt.Error)
+	return ok && libvirtErr.Code == uint32(code)
+}
+
+// planStoragePool returns the actions needed for the storage pool name, with
+// its files in path, to exist, be running and be started automatically.
+func planStoragePool(l *libvirt.Libvirt, name, path string) ([]setupAction, error) {
+	pool, err := l.StoragePoolLookupByName(name)
+	if isLibvirtError(err, libvirt.ErrNoStoragePool) {
+		poolXML, err := storagePoolXML(name, path)
+		if err != nil {
+			return nil, err
+		}
+		return []setupAction{{
+			description: fmt.Sprintf("define, build, start and autostart storage pool %s in %s", name, path),
+			xml:         poolXML,
+			apply: func() error {
+				pool, err := l.StoragePoolDefineXML(poolXML, 0)
+				if err != nil {
+					return fmt.Errorf("failed to define storage pool %s: %v", name, err)
+				}
+				if err := l.StoragePoolBuild(pool, libvirt.StoragePoolBuildNew); err != nil {
+					return fmt.Errorf("failed to build storage pool %s: %v", name, err)
+				}
+				if err := l.StoragePoolCreate(pool, 0); err != nil {
+					return fmt.Errorf("failed to start storage pool %s: %v", name, err)
+				}
+				if err := l.StoragePoolSetAutostart(pool, 1); err != nil {
+					return fmt.Errorf("failed to autostart storage pool %s: %v", name, err)
+				}
+				return nil
+			},
+		}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup storage pool %s: %v", name, err)
+	}
+
+	var actions []setupAction
+	active, err := l.StoragePoolIsActive(pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of storage pool %s: %v", name, err)
+	}
+	if active == 0 {
+		actions = append(actions, setupAction{
+			description: fmt.Sprintf("start storage pool %s", name),
+			apply: func() error {
+				return l.StoragePoolCreate(pool, 0)
+			},
+		})
+	}
+	autostart, err := l.StoragePoolGetAutostart(pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get autostart of storage pool %s: %v", name, err)
+	}
+	if autostart == 0 {
+		actions = append(actions, setupAction{
+			description:   fmt.Sprintf("autostart storage pool %s", name),
+			autostartOnly: true,
+			apply: func() error {
+				return l.StoragePoolSetAutostart(pool, 1)
+			},
+		})
+	}
+	return actions, nil
+}
+
+// planNetwork returns the actions needed for the network name to be running
+// and be started automatically. The network is not created as its addressing
+// depends on the host.
+func planNetwork(l *libvirt.Libvirt, name string) ([]setupAction, error) {
+	network, err := l.NetworkLookupByName(name)
+	if isLibvirtError(err, libvirt.ErrNoNetwork) {
+		return nil, fmt.Errorf("network %s does not exist - define it with virsh net-define or choose another network", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup network %s: %v", name, err)
+	}
+
+	var actions []setupAction
+	active, err := l.NetworkIsActive(network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of network %s: %v", name, err)
+	}
+	if active == 0 {
+		actions = append(actions, setupAction{
+			description: fmt.Sprintf("start network %s", name),
+			apply: func() error {
+				return l.NetworkCreate(network)
+			},
+		})
+	}
+	autostart, err := l.NetworkGetAutostart(network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get autostart of network %s: %v", name, err)
+	}
+	if autostart == 0 {
+		actions = append(actions, setupAction{
+			description:   fmt.Sprintf("autostart network %s", name),
+			autostartOnly: true,
+			apply: func() error {
+				return l.NetworkSetAutostart(network, 1)
+			},
+		})
+	}
+	return actions, nil
+}
+
+// planSetup returns the actions needed to set up the nixinit storage pools
+// under poolDirectory and the network used by bootstraps.
+func planSetup(l *libvirt.Libvirt, poolDirectory, network string) ([]setupAction, error) {
+	var actions []setupAction
+	pools := []struct{ name, subdirectory string }{
+		{nixinitIsoPoolName, "iso"},
+		{nixinitVolumePoolName, "volume"},
+	}
+	for _, pool := range pools {
+		poolActions, err := planStoragePool(l, pool.name, filepath.Join(poolDirectory, pool.subdirectory))
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, poolActions...)
+	}
+
+	networkActions, err := planNetwork(l, network)
+	if err != nil {
+		return nil, err
+	}
+	return append(actions, networkActions...), nil
+}
+
+// checkLibvirtSetup returns an error if the nixinit storage pools or network
+// are not ready for a bootstrap.
+func checkLibvirtSetup(l *libvirt.Libvirt, network string) error {
+	actions, err := planSetup(l, defaultPoolDirectory, network)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, action := range actions {
+		if !action.autostartOnly {
+			missing = append(missing, action.description)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("libvirt is not set up for nixinit (needs to %s) - run nixinit setup", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+func setup(cmd *cobra.Command, args []string) {
+	if !filepath.IsAbs(setupPoolDirectory) {
+		pterm.Error.Printf("--pool-dir must be an absolute path - exiting...\n")
+		return
+	}
+
+	l, err := connectLibvirt()
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
+		return
+	}
+	defer l.Disconnect()
+
+	actions, err := planSetup(l, setupPoolDirectory, setupNetwork)
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
+		return
+	}
+	if len(actions) == 0 {
+		pterm.Success.Printf("libvirt at %s is already set up for nixinit\n", libvirtURI)
+		return
+	}
+
+	for _, action := range actions {
+		if setupDryRun {
+			pterm.Info.Printf("Would %s\n", action.description)
+			if action.xml != "" {
+				fmt.Println(action.xml)
+			}
+			continue
+		}
+
+		pterm.Info.Printf("Will %s...\n", action.description)
+		if err := action.apply(); err != nil {
+			pterm.Error.Printf("%v\n", err)
+			return
+		}
+	}
+	if !setupDryRun {
+		pterm.Success.Printf("libvirt at %s is set up for nixinit\n", libvirtURI)
+	}
+}
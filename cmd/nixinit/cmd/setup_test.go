@@ -0,0 +1,19 @@
+package cmd
+
+import "testing"
+
+func TestStoragePoolXML(t *testing.T) {
+	poolXML, err := storagePoolXML("nixinit-iso", "/srv/nixinit/a&b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `<pool type="dir">
+  <name>nixinit-iso</name>
+  <target>
+    <path>/srv/nixinit/a&amp;b</path>
+  </target>
+</pool>`
+	if poolXML != expected {
+		t.Errorf("expected pool XML\n%s\ngot\n%s", expected, poolXML)
+	}
+}
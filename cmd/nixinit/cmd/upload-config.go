@@ -2,11 +2,13 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/pkg/sftp"
 	"github.com/pterm/pterm"
@@ -14,6 +16,7 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"gopkg.in/yaml.v3"
 )
 
 // uploadConfigCmd represents the uploadConfig command
@@ -29,8 +32,37 @@ var (
 	port                  int
 	configurationFilename string
 	instanceID            string
+	substituters          []string
+	trustedPublicKeys     []string
+	netrcFilename         string
+	maxJobs               string
+	cores                 int
+	diskLayoutFilename    string
+	verify                bool
+	verifyUser            string
+	verifySSHPort         int
+	verifyTimeout         time.Duration
 )
 
+var (
+	// nixSettingsFilename is the name of the file containing the nix settings
+	// which the server applies for the duration of the remote build.
+	nixSettingsFilename = "nix-settings.yaml"
+	// remoteDiskLayoutFilename is the name under which a disk layout is
+	// uploaded; its presence makes the server install to disk.
+	remoteDiskLayoutFilename = "disk-layout.nix"
+)
+
+// NixSettings contains nix settings which are applied by the server only
+// while building the uploaded configuration.
+type NixSettings struct {
+	Substituters      []string `yaml:"substituters,omitempty"`
+	TrustedPublicKeys []string `yaml:"trusted_public_keys,omitempty"`
+	Netrc             string   `yaml:"netrc,omitempty"`
+	MaxJobs           string   `yaml:"max_jobs,omitempty"`
+	Cores             int      `yaml:"cores,omitempty"`
+}
+
 func init() {
 	rootCmd.AddCommand(uploadConfigCmd)
 
@@ -46,35 +78,73 @@ func init() {
 	uploadConfigCmd.Flags().IntVarP(&port, "port", "p", 2222, "Remote port to upload the configuration to")
 	uploadConfigCmd.Flags().StringVarP(&configurationFilename, "file", "f", configurationNixFilename, "Name of nixOS configuration file to upload")
 	uploadConfigCmd.Flags().StringVarP(&instanceID, "instance", "i", "", "ID of bootstrapping instance")
+	uploadConfigCmd.Flags().StringSliceVar(&substituters, "substituter", nil, "Extra binary cache to use for the remote build (can be repeated)")
+	uploadConfigCmd.Flags().StringSliceVar(&trustedPublicKeys, "trusted-public-key", nil, "Extra public key trusted for binary caches (can be repeated)")
+	uploadConfigCmd.Flags().StringVar(&netrcFilename, "netrc-file", "", "netrc file with credentials for binary caches")
+	uploadConfigCmd.Flags().StringVar(&maxJobs, "max-jobs", "", "Maximum number of parallel build jobs (number or auto)")
+	uploadConfigCmd.Flags().IntVar(&cores, "cores", 0, "Number of cores each build job may use (0 for all)")
+	uploadConfigCmd.Flags().StringVar(&nixpkgsChannel, "nixpkgs-channel", "", "nixpkgs channel to build with, ie nixos-24.11 (default "+defaultNixpkgsChannel+")")
+	uploadConfigCmd.Flags().StringVar(&nixpkgsRev, "nixpkgs-rev", "", "nixpkgs commit to build with; requires --nixpkgs-nar-hash")
+	uploadConfigCmd.Flags().StringVar(&nixpkgsNarHash, "nixpkgs-nar-hash", "", "NAR hash (sha256-...) of the nixpkgs commit given by --nixpkgs-rev")
+	uploadConfigCmd.Flags().StringVar(&stateVersion, "state-version", "", "default system.stateVersion if not set in the configuration (default: the release of the channel)")
+	uploadConfigCmd.Flags().StringVar(&flakeLockFilename, "flake-lock", "", "flake.lock to upload for the generated flake")
+	uploadConfigCmd.Flags().BoolVar(&lockFlake, "lock", false, "lock the inputs of the generated flake locally with nix and upload the lock file")
+	uploadConfigCmd.Flags().StringVar(&diskLayoutFilename, "disk-layout", "", "disko disk layout; if set, the configuration is installed to disk rather than applied to the running system")
+	uploadConfigCmd.Flags().BoolVar(&verify, "verify", false, "wait for the instance to reboot into the new configuration and verify that it is running")
+	uploadConfigCmd.Flags().StringVar(&verifyUser, "user", "nixos", "user configured in the uploaded configuration with which to log in to verify it")
+	uploadConfigCmd.Flags().IntVar(&verifySSHPort, "ssh-port", 22, "ssh port of the instance once it is running the uploaded configuration")
+	uploadConfigCmd.Flags().DurationVar(&verifyTimeout, "verify-timeout", 30*time.Minute, "how long to wait for the configuration to be applied and the instance to reboot")
 }
 
-func uploadConfig(cmd *cobra.Command, args []string) {
-	if instanceID == "" {
-		pterm.Error.Println("Instance ID is required to upload configuration - exiting... ")
-		return
+// getNixSettings builds the nix settings from the command line flags; it
+// returns nil if no settings were specified.
+func getNixSettings() (*NixSettings, error) {
+	settings := NixSettings{
+		Substituters:      substituters,
+		TrustedPublicKeys: trustedPublicKeys,
+		MaxJobs:           maxJobs,
+		Cores:             cores,
 	}
 
-	// check if configuration.nix exists
-	pterm.Info.Printf("Checking if %s exists...\n", configurationFilename)
-	if _, err := os.Stat(configurationFilename); err != nil {
-		pterm.Error.Printf("%s does not exist - exiting...\n", configurationFilename)
-		return
+	if netrcFilename != "" {
+		cleanedFilename := filepath.Clean(netrcFilename)
+		netrc, err := os.ReadFile(cleanedFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read netrc file: %v", err)
+		}
+		settings.Netrc = string(netrc)
 	}
-	pterm.Info.Printf("%s found - will attempt to upload\n", configurationFilename)
 
+	if len(settings.Substituters) == 0 && len(settings.TrustedPublicKeys) == 0 &&
+		settings.Netrc == "" && settings.MaxJobs == "" && settings.Cores == 0 {
+		return nil, nil
+	}
+	return &settings, nil
+}
+
+// dialNixinitServer opens an ssh connection to the nixinit-server at addr:port
+// as the nixinit user, authenticating with the keys in the ssh agent.
+func dialNixinitServer(addr string, port int) (*ssh.Client, error) {
+	return dialSSH("nixinit", addr, port)
+}
+
+// dialSSH opens an ssh connection to addr:port as user, authenticating with
+// the keys in the ssh agent.
+func dialSSH(user, addr string, port int) (*ssh.Client, error) {
 	// clientConfig, _ := auth.SshAgent("nixinit", ssh.InsecureIgnoreHostKey())
 
 	config := &ssh.ClientConfig{
-		User: "nixinit",
+		User: user,
 		// for testing only
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // #nosec G106
+		Timeout:         10 * time.Second,
 	}
 
 	socket := os.Getenv("SSH_AUTH_SOCK")
 
 	conn, err := net.Dial("unix", socket)
 	if err != nil {
-		log.Fatalf("Failed to open SSH_AUTH_SOCK: %v", err)
+		return nil, fmt.Errorf("failed to open SSH_AUTH_SOCK: %v", err)
 	}
 
 	agentClient := agent.NewClient(conn)
@@ -84,13 +154,92 @@ func uploadConfig(cmd *cobra.Command, args []string) {
 
 	sshAddr := fmt.Sprintf("%s:%d", addr, port)
 	pterm.Info.Printf("Connecting to ssh server on %s...\n", sshAddr)
-	sshClient, err := ssh.Dial("tcp", sshAddr, config)
+	return ssh.Dial("tcp", sshAddr, config)
+}
+
+// uploadFile writes data to remoteFilename on the remote machine.
+func uploadFile(client *sftp.Client, remoteFilename string, data []byte) error {
+	f, err := client.Create(remoteFilename)
+	if err != nil {
+		return fmt.Errorf("failed to create file on remote machine: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write to file on remote machine: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close file on remote machine: %v", err)
+	}
+	return nil
+}
+
+func uploadConfig(cmd *cobra.Command, args []string) {
+	if instanceID == "" {
+		pterm.Error.Println("Instance ID is required to upload configuration - exiting... ")
+		return
+	}
+
+	// check if configuration.nix exists
+	pterm.Info.Printf("Checking if %s exists...\n", configurationFilename)
+	if _, err := os.Stat(configurationFilename); err != nil {
+		pterm.Error.Printf("%s does not exist - exiting...\n", configurationFilename)
+		return
+	}
+	pterm.Info.Printf("%s found - will attempt to upload\n", configurationFilename)
+
+	nixSettings, err := getNixSettings()
+	if err != nil {
+		pterm.Error.Printf("Invalid nix settings: %v - exiting...\n", err)
+		return
+	}
+
+	nixpkgsSource, err := getNixpkgsSource()
+	if err != nil {
+		pterm.Error.Printf("Invalid nixpkgs source: %v - exiting...\n", err)
+		return
+	}
+
+	var diskLayoutData []byte
+	if diskLayoutFilename != "" {
+		cleanedFilename := filepath.Clean(diskLayoutFilename)
+		diskLayoutData, err = os.ReadFile(cleanedFilename)
+		if err != nil {
+			pterm.Error.Printf("Failed to read disk layout %s: %v - exiting...\n", diskLayoutFilename, err)
+			return
+		}
+		pterm.Warning.Printf("Disk layout %s will be used to install to disk - all data on its disks will be destroyed\n", diskLayoutFilename)
+	}
+
+	var flakeLockData []byte
+	switch {
+	case flakeLockFilename != "" && lockFlake:
+		pterm.Error.Printf("Only one of --flake-lock and --lock may be set - exiting...\n")
+		return
+	case flakeLockFilename != "":
+		cleanedFilename := filepath.Clean(flakeLockFilename)
+		flakeLockData, err = os.ReadFile(cleanedFilename)
+		if err != nil {
+			pterm.Error.Printf("Failed to read flake lock %s: %v - exiting...\n", flakeLockFilename, err)
+			return
+		}
+	case lockFlake:
+		pterm.Info.Printf("Locking flake inputs...\n")
+		flakeLockData, err = generateFlakeLock(nixpkgsSource, diskLayoutData != nil)
+		if err != nil {
+			pterm.Error.Printf("Failed to lock flake inputs: %v - exiting...\n", err)
+			return
+		}
+	}
+
+	sshClient, err := dialNixinitServer(addr, port)
 	if err != nil {
 		log.Fatalf("Failed to dial: %v", err)
 	}
 	defer sshClient.Close()
 
-	uploadFilename := filepath.Join("/uploads/nixinit", instanceID, configurationNixFilename)
+	uploadDirectory := filepath.Join("/uploads/nixinit", instanceID)
+	uploadFilename := filepath.Join(uploadDirectory, configurationNixFilename)
 
 	pterm.Info.Printf("Uploading configuration file...\n")
 	// open an SFTP session over an existing ssh connection.
@@ -101,6 +250,75 @@ func uploadConfig(cmd *cobra.Command, args []string) {
 	}
 	defer client.Close()
 
+	// files left by an earlier upload which did not complete would be applied
+	// with this configuration, so any optional file which is not being sent is
+	// removed
+	optionalFiles := map[string]bool{
+		nixSettingsFilename:      nixSettings != nil,
+		nixpkgsFilename:          nixpkgsSource != nil,
+		remoteFlakeLockFilename:  flakeLockData != nil,
+		remoteDiskLayoutFilename: diskLayoutData != nil,
+	}
+	for filename, sent := range optionalFiles {
+		if sent {
+			continue
+		}
+		err := client.Remove(filepath.Join(uploadDirectory, filename))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to remove stale %s: %v", filename, err)
+			return
+		}
+	}
+
+	// the nix settings, nixpkgs source, lock file and disk layout must be in
+	// place before configuration.nix is uploaded as the upload of
+	// configuration.nix triggers the build
+	if nixSettings != nil {
+		nixSettingsData, err := yaml.Marshal(nixSettings)
+		if err != nil {
+			log.Printf("failed to marshal nix settings: %v", err)
+			return
+		}
+		err = uploadFile(client, filepath.Join(uploadDirectory, nixSettingsFilename), nixSettingsData)
+		if err != nil {
+			log.Printf("failed to upload nix settings: %v", err)
+			return
+		}
+		pterm.Info.Printf("Nix settings uploaded...\n")
+	}
+
+	if nixpkgsSource != nil {
+		nixpkgsData, err := yaml.Marshal(nixpkgsSource)
+		if err != nil {
+			log.Printf("failed to marshal nixpkgs source: %v", err)
+			return
+		}
+		err = uploadFile(client, filepath.Join(uploadDirectory, nixpkgsFilename), nixpkgsData)
+		if err != nil {
+			log.Printf("failed to upload nixpkgs source: %v", err)
+			return
+		}
+		pterm.Info.Printf("Nixpkgs source uploaded...\n")
+	}
+
+	if flakeLockData != nil {
+		err = uploadFile(client, filepath.Join(uploadDirectory, remoteFlakeLockFilename), flakeLockData)
+		if err != nil {
+			log.Printf("failed to upload flake lock: %v", err)
+			return
+		}
+		pterm.Info.Printf("Flake lock uploaded...\n")
+	}
+
+	if diskLayoutData != nil {
+		err = uploadFile(client, filepath.Join(uploadDirectory, remoteDiskLayoutFilename), diskLayoutData)
+		if err != nil {
+			log.Printf("failed to upload disk layout: %v", err)
+			return
+		}
+		pterm.Info.Printf("Disk layout uploaded...\n")
+	}
+
 	// read file into buffer
 	cleanedFilename := filepath.Clean(configurationFilename)
 	configurationFileData, err := os.ReadFile(cleanedFilename)
@@ -109,19 +327,32 @@ func uploadConfig(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	f, err := client.Create(uploadFilename)
+	err = uploadFile(client, uploadFilename, configurationFileData)
 	if err != nil {
-		log.Printf("failed to create file on remote machine: %v", err)
+		log.Printf("failed to upload configuration file: %v", err)
 		return
 	}
-	if _, err := f.Write(configurationFileData); err != nil {
-		log.Printf("failed to write to file on remote machine: %v", err)
+	pterm.Success.Printf("Configuration file uploaded...\n")
+
+	if !verify {
 		return
 	}
-	err = f.Close()
+	// the server numbers each upload as it completes, so the most recent
+	// upload is this one, unless another client has uploaded since
+	status, err := getServerStatus(addr, port)
 	if err != nil {
-		log.Printf("failed to close file on remote machine: %v", err)
+		pterm.Error.Printf("Failed to read server status: %v - cannot verify\n", err)
+		return
+	}
+	if status.UploadSequence == 0 {
+		pterm.Error.Printf("Server does not number uploads - cannot verify\n")
+		return
+	}
+	// the sftp session must not hold the connection open across the reboot
+	client.Close()
+	sshClient.Close()
+	if err := verifyConfiguration(addr, port, status.UploadSequence, verifyUser, verifySSHPort, verifyTimeout); err != nil {
+		pterm.Error.Printf("Verification failed: %v\n", err)
 		return
 	}
-	pterm.Success.Printf("Configuration file uploaded...\n")
 }
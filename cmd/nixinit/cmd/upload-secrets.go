@@ -0,0 +1,100 @@
+// Package cmd provides the command-line interface for the nixinit-server application.
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"github.com/pterm/pterm"
+
+	"github.com/spf13/cobra"
+)
+
+// uploadSecretsCmd represents the uploadSecrets command
+var uploadSecretsCmd = &cobra.Command{
+	Use:   "upload-secrets [file...]",
+	Short: "uploads secrets to a remote bootstrapping nixos instance",
+	Long: `uploads secrets (host keys, age identities, API tokens, etc) to a remote
+bootstrapping nixos instance. The secrets are moved to /var/lib/nixinit/secrets
+on the instance, readable only by root, when the configuration is applied; they
+are never copied into /etc/nixos. Secrets must be uploaded before the
+configuration.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  uploadSecrets,
+}
+
+// secretsUploadDirectory is the subdirectory of the instance upload directory
+// which the server imports secrets from.
+var secretsUploadDirectory = "secrets"
+
+func init() {
+	rootCmd.AddCommand(uploadSecretsCmd)
+
+	uploadSecretsCmd.Flags().StringVarP(&addr, "addr", "a", "localhost", "Remote address to upload the secrets to")
+	uploadSecretsCmd.Flags().IntVarP(&port, "port", "p", 2222, "Remote port to upload the secrets to")
+	uploadSecretsCmd.Flags().StringVarP(&instanceID, "instance", "i", "", "ID of bootstrapping instance")
+}
+
+// readSecrets reads filenames, keyed by the name they are uploaded as. Secrets
+// are uploaded under their base name, so two files with the same base name are
+// rejected rather than one silently replacing the other.
+func readSecrets(filenames []string) (map[string][]byte, error) {
+	secrets := make(map[string][]byte, len(filenames))
+	uploadedFrom := make(map[string]string, len(filenames))
+	for _, filename := range filenames {
+		cleanedFilename := filepath.Clean(filename)
+		name := filepath.Base(cleanedFilename)
+		if previous, ok := uploadedFrom[name]; ok {
+			return nil, fmt.Errorf("secrets %s and %s would both be uploaded as %s", previous, filename, name)
+		}
+		data, err := os.ReadFile(cleanedFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s: %v", filename, err)
+		}
+		secrets[name] = data
+		uploadedFrom[name] = filename
+	}
+	return secrets, nil
+}
+
+func uploadSecrets(cmd *cobra.Command, args []string) {
+	if instanceID == "" {
+		pterm.Error.Println("Instance ID is required to upload secrets - exiting... ")
+		return
+	}
+
+	// read all of the secrets before connecting so that nothing is uploaded if
+	// any of them is missing
+	secrets, err := readSecrets(args)
+	if err != nil {
+		pterm.Error.Printf("%v - exiting...\n", err)
+		return
+	}
+
+	sshClient, err := dialNixinitServer(addr, port)
+	if err != nil {
+		log.Fatalf("Failed to dial: %v", err)
+	}
+	defer sshClient.Close()
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		log.Printf("failed to create SFTP client: %v", err)
+		return
+	}
+	defer client.Close()
+
+	uploadDirectory := filepath.Join("/uploads/nixinit", instanceID, secretsUploadDirectory)
+	for name, data := range secrets {
+		pterm.Info.Printf("Uploading secret %s...\n", name)
+		err = uploadFile(client, filepath.Join(uploadDirectory, name), data)
+		if err != nil {
+			log.Printf("failed to upload secret %s: %v", name, err)
+			return
+		}
+	}
+	pterm.Success.Printf("%d secret(s) uploaded...\n", len(secrets))
+}
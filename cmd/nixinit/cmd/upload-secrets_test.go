@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSecrets(t *testing.T) {
+	directory := t.TempDir()
+	for _, name := range []string{"token", "other/token", "key"} {
+		path := filepath.Join(directory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		filenames []string
+		expected  map[string]string
+	}{
+		{
+			name:      "distinct names",
+			filenames: []string{filepath.Join(directory, "token"), filepath.Join(directory, "key")},
+			expected:  map[string]string{"token": "token", "key": "key"},
+		},
+		{
+			name:      "duplicate base name",
+			filenames: []string{filepath.Join(directory, "token"), filepath.Join(directory, "other", "token")},
+		},
+		{
+			name:      "same file twice",
+			filenames: []string{filepath.Join(directory, "key"), filepath.Join(directory, ".", "key")},
+		},
+		{
+			name:      "missing file",
+			filenames: []string{filepath.Join(directory, "missing")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secrets, err := readSecrets(test.filenames)
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %v", secrets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(secrets) != len(test.expected) {
+				t.Errorf("expected %d secrets, got %d", len(test.expected), len(secrets))
+			}
+			for name, data := range test.expected {
+				if string(secrets[name]) != data {
+					t.Errorf("expected secret %s to be %q, got %q", name, data, secrets[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Package cmd provides the command-line interface for the nixinit-server application.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+const (
+	// serverStateApplied and serverStateError are the nixinit-server states
+	// which end an apply.
+	serverStateApplied = "NIX_CONFIG_APPLIED"
+	serverStateError   = "NIXINIT_ERROR"
+
+	verifyPollInterval = 5 * time.Second
+)
+
+// serverStatus is the part of the nixinit-server ssh banner, in json format,
+// used to follow an apply and to list bootstraps.
+type serverStatus struct {
+	ServerStatus     string `json:"server_status"`
+	LastApplyResult  string `json:"last_apply_result"`
+	ExpectedToplevel string `json:"expected_toplevel"`
+	// SystemUptime is the time since the instance last booted.
+	SystemUptime string `json:"system_uptime"`
+	// UploadSequence is the number of the most recent upload of
+	// configuration.nix, and LastApplyUpload that of the upload which
+	// LastApplyResult belongs to.
+	UploadSequence  int64 `json:"upload_sequence"`
+	LastApplyUpload int64 `json:"last_apply_upload"`
+}
+
+// getServerStatus reads the status banner of the nixinit-server at addr:port.
+func getServerStatus(addr string, port int) (serverStatus, error) {
+	var status serverStatus
+
+	sshClient, err := dialNixinitServer(addr, port)
+	if err != nil {
+		return status, err
+	}
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return status, fmt.Errorf("failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	output, err := session.Output("--format json")
+	if err != nil {
+		return status, fmt.Errorf("failed to read server status: %v", err)
+	}
+	if err := json.Unmarshal(output, &status); err != nil {
+		return status, fmt.Errorf("failed to parse server status: %v", err)
+	}
+	return status, nil
+}
+
+// applyWatcher follows the states reported by the nixinit-server after an
+// upload. Only the result of an apply of this upload, identified by the
+// number the server gave it, is accepted; results of earlier uploads, such as
+// a failure left over from an earlier attempt, are ignored.
+type applyWatcher struct {
+	// upload is the number of the upload being followed.
+	upload int64
+}
+
+// observe returns true, with the toplevel store path of the new system or the
+// reason the apply failed, once status shows that the upload has been applied.
+func (w *applyWatcher) observe(status serverStatus) (bool, string, error) {
+	switch {
+	case status.LastApplyUpload < w.upload:
+		return false, "", nil
+	case status.LastApplyUpload > w.upload:
+		return true, "", fmt.Errorf("configuration was replaced by a later upload before it was applied")
+	case status.ServerStatus == serverStateError:
+		return true, "", fmt.Errorf("configuration was not applied: %s", status.LastApplyResult)
+	case status.ServerStatus == serverStateApplied:
+		// the toplevel is recorded just after the state changes
+		return status.ExpectedToplevel != "", status.ExpectedToplevel, nil
+	default:
+		return false, "", nil
+	}
+}
+
+// waitForApply polls the nixinit-server until the upload numbered upload has
+// been applied, returning the toplevel store path of the system which the
+// instance reboots into.
+func waitForApply(ctx context.Context, addr string, port int, upload int64) (string, error) {
+	watcher := applyWatcher{upload: upload}
+	for {
+		status, err := getServerStatus(addr, port)
+		if err != nil {
+			pterm.Debug.Printf("status check failed: %v\n", err)
+		} else {
+			done, toplevel, err := watcher.observe(status)
+			if done {
+				return toplevel, err
+			}
+			pterm.Info.Printf("Waiting for configuration to be applied (%s)...\n", status.ServerStatus)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("configuration not applied in time")
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+// waitForShutdown polls the nixinit-server until it stops answering, ie the
+// instance has started to reboot.
+func waitForShutdown(ctx context.Context, addr string, port int) error {
+	for {
+		if _, err := getServerStatus(addr, port); err != nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("instance did not reboot in time")
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+// getCurrentSystem logs in to addr:port as user and returns the store path of
+// the running system.
+func getCurrentSystem(user, addr string, port int) (string, error) {
+	sshClient, err := dialSSH(user, addr, port)
+	if err != nil {
+		return "", err
+	}
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to open session: %v", err)
+	}
+	defer session.Close()
+
+	output, err := session.Output("readlink /run/current-system")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /run/current-system: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// waitForSystem polls addr:port until user can log in, returning the store
+// path of the running system.
+func waitForSystem(ctx context.Context, user, addr string, port int) (string, error) {
+	for {
+		system, err := getCurrentSystem(user, addr, port)
+		if err == nil {
+			return system, nil
+		}
+		pterm.Debug.Printf("login as %s failed: %v\n", user, err)
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("could not log in as %s after the reboot: %v", user, err)
+		case <-time.After(verifyPollInterval):
+		}
+	}
+}
+
+// verifyConfiguration waits for the configuration uploaded to the
+// nixinit-server at addr:port to be applied and for the instance to reboot,
+// then logs in as user on sshPort and checks that the new system is running.
+// upload is the number the server gave the upload.
+func verifyConfiguration(addr string, port int, upload int64, user string, sshPort int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pterm.Info.Printf("Waiting for configuration to be applied...\n")
+	expected, err := waitForApply(ctx, addr, port, upload)
+	if err != nil {
+		return err
+	}
+	pterm.Info.Printf("Configuration applied - expecting %s after the reboot\n", expected)
+
+	if err := waitForShutdown(ctx, addr, port); err != nil {
+		return err
+	}
+	pterm.Info.Printf("Instance is rebooting - waiting for it to come back...\n")
+
+	running, err := waitForSystem(ctx, user, addr, sshPort)
+	if err != nil {
+		return err
+	}
+	if running != expected {
+		return fmt.Errorf("instance is running %s rather than %s", running, expected)
+	}
+	pterm.Success.Printf("Instance at %s is running the new configuration %s\n", addr, running)
+	return nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import "testing"
+
+func TestApplyWatcherFollowsUpload(t *testing.T) {
+	const upload = 3
+	toplevel := "/nix/store/abc-nixos-system"
+	tests := []struct {
+		name     string
+		status   serverStatus
+		done     bool
+		toplevel string
+		failed   bool
+	}{
+		{
+			name:   "error left over from an earlier upload",
+			status: serverStatus{ServerStatus: serverStateError, LastApplyUpload: upload - 1, UploadSequence: upload},
+		},
+		{
+			name:   "applying",
+			status: serverStatus{ServerStatus: "CONFIGURING_NIX_SYSTEM", LastApplyUpload: upload - 1, UploadSequence: upload},
+		},
+		{
+			name:   "failed",
+			status: serverStatus{ServerStatus: serverStateError, LastApplyUpload: upload, UploadSequence: upload},
+			done:   true,
+			failed: true,
+		},
+		{
+			name:     "applied",
+			status:   serverStatus{ServerStatus: serverStateApplied, LastApplyUpload: upload, UploadSequence: upload, ExpectedToplevel: toplevel},
+			done:     true,
+			toplevel: toplevel,
+		},
+		{
+			name:   "result recorded before the state changes",
+			status: serverStatus{ServerStatus: "CONFIGURING_NIX_SYSTEM", LastApplyUpload: upload, UploadSequence: upload},
+		},
+		{
+			name:   "applied before the toplevel is recorded",
+			status: serverStatus{ServerStatus: serverStateApplied, LastApplyUpload: upload, UploadSequence: upload},
+		},
+		{
+			name:   "replaced by a later upload",
+			status: serverStatus{ServerStatus: serverStateApplied, LastApplyUpload: upload + 1, UploadSequence: upload + 1, ExpectedToplevel: toplevel},
+			done:   true,
+			failed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			watcher := applyWatcher{upload: upload}
+			done, toplevel, err := watcher.observe(test.status)
+			if done != test.done || toplevel != test.toplevel || (err != nil) != test.failed {
+				t.Errorf("expected done %v, toplevel %q, failed %v; got %v, %q, %v", test.done, test.toplevel, test.failed, done, toplevel, err)
+			}
+		})
+	}
+}
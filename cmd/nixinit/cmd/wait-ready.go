@@ -0,0 +1,88 @@
+// Package cmd provides the command-line interface for the nixinit-server application.
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pterm/pterm"
+	"github.com/spf13/cobra"
+)
+
+// waitReadyCmd represents the waitReady command
+var waitReadyCmd = &cobra.Command{
+	Use:   "wait-ready",
+	Short: "waits until a bootstrapping nixos instance is ready for its configuration",
+	Long: `wait-ready polls the status of the nixinit-server over ssh, on the same port
+as upload-config, until the server is ready to accept a configuration or the
+timeout expires. It exits with a non-zero status if the instance does not
+become ready in time.`,
+	Run: waitReady,
+}
+
+const (
+	// serverStateWaiting is the nixinit-server state in which it waits for a
+	// configuration to be uploaded.
+	serverStateWaiting = "WAITING_FOR_NIX_CONFIG"
+
+	readyPollInterval = 2 * time.Second
+)
+
+var readyTimeout time.Duration
+
+func init() {
+	rootCmd.AddCommand(waitReadyCmd)
+
+	waitReadyCmd.Flags().StringVarP(&addr, "addr", "a", "localhost", "Remote address of the bootstrapping instance")
+	waitReadyCmd.Flags().IntVarP(&port, "port", "p", 2222, "Port of the nixinit-server on the bootstrapping instance")
+	waitReadyCmd.Flags().DurationVar(&readyTimeout, "timeout", 5*time.Minute, "How long to wait for the instance to become ready")
+}
+
+// isReadyForConfig reports whether a nixinit-server with status accepts a
+// configuration; a server whose last apply failed accepts another.
+func isReadyForConfig(status serverStatus) bool {
+	return status.ServerStatus == serverStateWaiting || status.ServerStatus == serverStateError
+}
+
+// waitForReady polls the status of the nixinit-server at addr:port, read with
+// getStatus, until it is ready for a configuration or the timeout expires.
+func waitForReady(addr string, port int, timeout time.Duration, getStatus func(string, int) (serverStatus, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// the server only accepts ssh connections once it has determined the
+		// instance id, so connection failures are expected while it starts
+		status, err := getStatus(addr, port)
+		switch {
+		case err != nil:
+			pterm.Debug.Printf("status check failed: %v\n", err)
+		case isReadyForConfig(status):
+			return nil
+		default:
+			pterm.Info.Printf("Instance not ready yet (%s)...\n", status.ServerStatus)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("instance not ready after %v", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func waitReady(cmd *cobra.Command, args []string) {
+	pterm.Info.Printf("Waiting for instance at %s to become ready...\n", addr)
+
+	err := waitForReady(addr, port, readyTimeout, getServerStatus)
+	if err != nil {
+		pterm.Error.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	pterm.Success.Printf("Instance at %s is ready for configuration\n", addr)
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// statusSequence returns the statuses in turn, failing the first failures
+// status checks as a server which is not yet listening would, and then
+// repeating the last status.
+func statusSequence(failures int, states ...string) func(string, int) (serverStatus, error) {
+	return func(addr string, port int) (serverStatus, error) {
+		if failures > 0 {
+			failures--
+			return serverStatus{}, errors.New("connection refused")
+		}
+		status := serverStatus{ServerStatus: states[0]}
+		if len(states) > 1 {
+			states = states[1:]
+		}
+		return status, nil
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		states   []string
+	}{
+		{"waiting", 0, []string{serverStateWaiting}},
+		{"after the last apply failed", 0, []string{serverStateError}},
+		{"once listening", 1, []string{serverStateWaiting}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := waitForReady("localhost", 2222, 10*time.Second, statusSequence(test.failures, test.states...)); err != nil {
+				t.Errorf("expected the instance to be ready: %v", err)
+			}
+		})
+	}
+}
+
+func TestWaitForReadyTimesOut(t *testing.T) {
+	for _, state := range []string{"CONFIGURING_NIX_SYSTEM", serverStateApplied} {
+		start := time.Now()
+		if err := waitForReady("localhost", 2222, 100*time.Millisecond, statusSequence(0, state)); err == nil {
+			t.Errorf("expected waiting for an instance in state %s to time out", state)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected to give up once the timeout expired, took %v", elapsed)
+		}
+	}
+}
@@ -34,6 +34,25 @@ in
           The port to run the service on
         '';
       };
+
+      httpAddress = mkOption {
+        type = types.nullOr types.str;
+        default = null;
+        example = "127.0.0.1:8080";
+        description = ''
+          Address on which to expose the /healthz, /readyz, /status and
+          /metrics endpoints; disabled if null
+        '';
+      };
+
+      dataDirectory = mkOption {
+        type = types.path;
+        default = "/var/lib/nixinit";
+        description = ''
+          Directory holding uploaded and staged configurations, secrets and
+          logs
+        '';
+      };
     };
 
   };
@@ -55,16 +74,54 @@ in
 
     environment.systemPackages = [ pkgs.nixinit-server ];
 
+    # the data directory is owned by root so that the staged configuration and
+    # secrets cannot be tampered with; only the uploads are writable by nixinit
+    systemd.tmpfiles.rules = [
+      "d ${cfg.dataDirectory} 0755 root root -"
+      "d ${cfg.dataDirectory}/uploads 0750 nixinit nixinit -"
+    ];
+
+    # privileged operations - mounting the cidata volume, staging and applying
+    # uploaded configurations - are delegated to a root helper which is only
+    # reachable by the nixinit group
+    systemd.sockets.nixinit-helper = {
+      wantedBy = [ "sockets.target" ];
+      socketConfig = {
+        ListenStream = "/run/nixinit/helper.sock";
+        SocketUser = "root";
+        SocketGroup = "nixinit";
+        SocketMode = "0660";
+      };
+    };
+
+    systemd.services.nixinit-helper = {
+      requires = [ "nixinit-helper.socket" ];
+      serviceConfig = {
+        ExecStart = "${pkgs.nixinit-server}/bin/nixinit-server --helper --data-dir ${cfg.dataDirectory}";
+        # allow an in-flight build to be cancelled on stop
+        TimeoutStopSec = "60s";
+        Restart = "always";
+      };
+    };
+
     systemd.services.nixinit = {
       wantedBy = [ "multi-user.target" ];
+      requires = [ "nixinit-helper.socket" ];
+      after = [ "nixinit-helper.socket" ];
       serviceConfig = {
-        # the binary generated in this repo is called simple-rest-api and not
-        # simple-go-server.
-        ExecStart = "+${pkgs.nixinit-server}/bin/nixinit-server";
+        ExecStart = "${pkgs.nixinit-server}/bin/nixinit-server --helper-socket /run/nixinit/helper.sock"
+          + " --data-dir ${cfg.dataDirectory}"
+          + optionalString (cfg.httpAddress != null) " --http-addr ${cfg.httpAddress}";
         User = "nixinit";
-        PermissionsStartOnly = true;
+        Group = "nixinit";
+        NoNewPrivileges = true;
+        # nixinit-server notifies systemd once the ssh server is listening,
+        # reports its state and pings the watchdog
+        Type = "notify";
+        WatchdogSec = "30s";
+        # allow ssh sessions and an in-flight build to finish on stop
+        TimeoutStopSec = "60s";
         Restart = "always";
-        WorkingDirectory = "/home/nixinit";
       };
     };
   };
@@ -20,6 +20,13 @@ buildGoModule rec {
 
   subCommands = [ "cmd/nixinit-server" ];
 
+  ldflags = [
+    "-s"
+    "-w"
+    "-X main.version=${version}"
+    "-X main.commit=${src.rev}"
+  ];
+
   doCheck = false;
 
   meta = with lib; {
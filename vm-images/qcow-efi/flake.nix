@@ -7,6 +7,16 @@
     };
   };
   outputs = { self, nixpkgs, nixos-generators, ... }: {
+    # the aarch64 image is published as nixinit-bootstrap-aarch64.qcow2
+    packages.aarch64-linux = {
+      qcow-efi = nixos-generators.nixosGenerate {
+        system = "aarch64-linux";
+        modules = [
+          ./configuration.nix
+        ];
+        format = "qcow-efi";
+      };
+    };
     packages.x86_64-linux = {
       qcow-efi = nixos-generators.nixosGenerate {
         system = "x86_64-linux";